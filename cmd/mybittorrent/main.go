@@ -1,32 +1,60 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/tracker"
 )
 
-const BlockMaxSize = 16 * 1024
+// The client shared by all commands
+var client *torrent.Client
 
-func HandshakeMsg(infoHash []byte, peerId []byte) string {
-	var sb strings.Builder
-	sb.WriteByte(19)
-	sb.WriteString("BitTorrent protocol") // Don't capitalize "protocol"
-	for i := 0; i < 8; i++ {
-		sb.WriteByte(0)
+// The DHT routing table is kept in the user's cache directory between runs.
+// Returns "" if there's no cache directory.
+func dhtStateFile() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
 	}
-	sb.Write(infoHash)
-	sb.Write([]byte("deadbeefliveporkhaha"))
+	dir := filepath.Join(cacheDir, "mybittorrent")
+	if os.MkdirAll(dir, 0755) != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dht.state")
+}
 
-	return sb.String()
+// Parse a range of piece indices such as 10-20, or a single index.
+func parsePieceRange(str string) (int, int, error) {
+	firstStr, lastStr, found := strings.Cut(str, "-")
+	first, err := strconv.Atoi(firstStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !found {
+		return first, first, nil
+	}
+	last, err := strconv.Atoi(lastStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if first < 0 || last < first {
+		return 0, 0, fmt.Errorf("invalid piece range: %v", str)
+	}
+	return first, last, nil
 }
 
 func printDecoded(v interface{}) {
@@ -41,6 +69,22 @@ func main() {
 	}
 	command := os.Args[1]
 
+	torrent.Debug = Debug > 0
+	peer.Debug = Debug > 0
+	tracker.Debug = Debug > 0
+	client = torrent.NewClient()
+	client.DHTStateFile = dhtStateFile()
+	defer client.Close()
+
+	// Ctrl-C cancels ctx, which stops network operations and transfers
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// A second Ctrl-C kills the process right away
+		<-ctx.Done()
+		stop()
+	}()
+
 	if command == "decode" {
 		if len(os.Args) != 3 {
 			fmt.Println("Expect a single argument")
@@ -62,19 +106,20 @@ func main() {
 		bytes, err := os.ReadFile(filename)
 		exit_on_error(err)
 
-		torrent, err := parseTorrent(string(bytes))
+		t, err := torrent.Parse(bytes)
 		exit_on_error(err)
 
-		fmt.Printf("Tracker URL: %s\n", torrent.trackerUrl)
-		fmt.Printf("Length: %d\n", torrent.info.length)
+		fmt.Printf("Tracker URL: %s\n", t.TrackerURL)
+		fmt.Printf("Length: %d\n", t.Info.Length)
+		for _, file := range t.Info.Files {
+			fmt.Printf("File: %v (%d bytes)\n", strings.Join(file.Path, "/"), file.Length)
+		}
 
-		info_hash, err := torrent.info.hash()
-		exit_on_error(err)
-		fmt.Printf("Info Hash: %s\n", hex.EncodeToString(info_hash))
+		fmt.Printf("Info Hash: %s\n", hex.EncodeToString(t.InfoHash))
 
-		fmt.Printf("Piece Length: %v\n", torrent.info.pieceLength)
+		fmt.Printf("Piece Length: %v\n", t.Info.PieceLength)
 		// fmt.Printf("Piece Hashes:\n")
-		// for _, piece_hash := range torrent.info.pieces {
+		// for _, piece_hash := range t.Info.Pieces {
 		// 	fmt.Printf("%v\n", hex.EncodeToString([]byte(piece_hash)))
 		// }
 	} else if command == "peers" {
@@ -87,10 +132,10 @@ func main() {
 		bytes, err := os.ReadFile(filename)
 		exit_on_error(err)
 
-		torrent, err := parseTorrent(string(bytes))
+		t, err := torrent.Parse(bytes)
 		exit_on_error(err)
 
-		peers, err := torrent.discoverPeers()
+		peers, err := client.DiscoverPeers(ctx, t)
 		exit_on_error(err)
 
 		for _, peer := range peers {
@@ -108,28 +153,17 @@ func main() {
 		bytes, err := os.ReadFile(filename)
 		exit_on_error(err)
 
-		torrent, err := parseTorrent(string(bytes))
+		t, err := torrent.Parse(bytes)
 		exit_on_error(err)
 
-		infoHash, err := torrent.info.hash()
+		addr, err := net.ResolveTCPAddr("tcp", peer_address)
 		exit_on_error(err)
 
-		conn, err := net.Dial("tcp", peer_address)
+		pc, err := client.Connect(ctx, t, addr.AddrPort())
 		exit_on_error(err)
+		defer pc.Close()
 
-		defer conn.Close()
-
-		handshakeMsg := HandshakeMsg(infoHash, []byte("deadbeefliveporkhaha"))
-		_, err = conn.Write([]byte(handshakeMsg))
-		exit_on_error(err)
-
-		response := make([]byte, 68)
-		_, err = conn.Read(response)
-		if err != nil && !errors.Is(err, io.EOF) {
-			exit_on_error(err)
-		}
-
-		fmt.Printf("Peer ID: %v\n", hex.EncodeToString(response[48:]))
+		fmt.Printf("Peer ID: %v\n", hex.EncodeToString(pc.PeerID[:]))
 	} else if command == "download_piece" {
 		if len(os.Args) != 6 {
 			fmt.Println("Expect: -o output_file torrent_file piece_index")
@@ -143,10 +177,10 @@ func main() {
 		bytes, err := os.ReadFile(filename)
 		exit_on_error(err)
 
-		torrent, err := parseTorrent(string(bytes))
+		t, err := torrent.Parse(bytes)
 		exit_on_error(err)
 
-		pieceData, err := torrent.downloadPiece(piece)
+		pieceData, err := client.DownloadPiece(ctx, t, piece)
 		exit_on_error(err)
 
 		err = os.WriteFile(outputFilename, pieceData, 0644)
@@ -154,23 +188,197 @@ func main() {
 
 		fmt.Printf("Piece %v downloaded to %v\n", piece, outputFilename)
 	} else if command == "download" {
+		// Pieces in the range given with --prioritize are downloaded first
+		priorities := make(map[int]int)
+		args := os.Args
+		if len(args) == 7 && args[4] == "--prioritize" {
+			first, last, err := parsePieceRange(args[5])
+			exit_on_error(err)
+			for piece := first; piece <= last; piece++ {
+				priorities[piece] = torrent.PriorityHigh
+			}
+			args = append(args[:4:4], args[6])
+		}
+		if len(args) != 5 {
+			fmt.Println("Expect: -o output_file [--prioritize first-last] torrent_file")
+		}
+		outputFilename := args[3]
+		torrentFilename := args[4]
+
+		bytes, err := os.ReadFile(torrentFilename)
+		exit_on_error(err)
+
+		t, err := torrent.Parse(bytes)
+		exit_on_error(err)
+
+		err = client.Download(ctx, t, outputFilename, priorities)
+		exit_on_error(err)
+
+		fmt.Printf("Downloaded %v to %v\n", t.Info.Name, outputFilename)
+	} else if command == "magnet_parse" {
+		if len(os.Args) != 3 {
+			fmt.Println("Expect a magnet link")
+			os.Exit(1)
+		}
+
+		magnet, err := torrent.ParseMagnet(os.Args[2])
+		exit_on_error(err)
+
+		for _, trackerUrl := range magnet.Trackers {
+			fmt.Printf("Tracker URL: %s\n", trackerUrl)
+		}
+		fmt.Printf("Info Hash: %s\n", hex.EncodeToString(magnet.InfoHash))
+		if magnet.DisplayName != "" {
+			fmt.Printf("Name: %s\n", magnet.DisplayName)
+		}
+		if magnet.ExactLength != 0 {
+			fmt.Printf("Length: %d\n", magnet.ExactLength)
+		}
+	} else if command == "magnet_download" {
 		if len(os.Args) != 5 {
-			fmt.Println("Expect: -o output_file torrent_file")
+			fmt.Println("Expect: -o output_file magnet_link")
+			os.Exit(1)
 		}
 		outputFilename := os.Args[3]
-		torrentFilename := os.Args[4]
+
+		magnet, err := torrent.ParseMagnet(os.Args[4])
+		exit_on_error(err)
+
+		t := magnet.Torrent()
+		err = client.FetchInfo(ctx, t)
+		exit_on_error(err)
+
+		err = client.Download(ctx, t, outputFilename, nil)
+		exit_on_error(err)
+
+		fmt.Printf("Downloaded %v to %v\n", t.Info.Name, outputFilename)
+	} else if command == "scrape" {
+		if len(os.Args) < 3 {
+			fmt.Println("Expect one or more torrent files")
+			os.Exit(1)
+		}
+
+		// Group info hashes by tracker so that each tracker is scraped once
+		hashesByTracker := make(map[string][][]byte)
+		trackerUrls := make([]string, 0)
+		names := make(map[string]string)
+		for _, filename := range os.Args[2:] {
+			bytes, err := os.ReadFile(filename)
+			exit_on_error(err)
+
+			t, err := torrent.Parse(bytes)
+			exit_on_error(err)
+
+			infoHash := t.InfoHash
+			names[string(infoHash)] = t.Info.Name
+
+			for _, tier := range t.TrackerTiers {
+				for _, trackerUrl := range tier {
+					if _, ok := hashesByTracker[trackerUrl]; !ok {
+						trackerUrls = append(trackerUrls, trackerUrl)
+					}
+					hashesByTracker[trackerUrl] = append(hashesByTracker[trackerUrl], infoHash)
+				}
+			}
+		}
+
+		for _, trackerUrl := range trackerUrls {
+			fmt.Printf("Tracker: %v\n", trackerUrl)
+			infoHashes := hashesByTracker[trackerUrl]
+			results, err := tracker.Scrape(ctx, trackerUrl, infoHashes)
+			if err != nil {
+				fmt.Printf("  Error: %v\n", err)
+				continue
+			}
+			for _, infoHash := range infoHashes {
+				res, ok := results[string(infoHash)]
+				if !ok {
+					fmt.Printf("  %v: unknown to tracker\n", names[string(infoHash)])
+					continue
+				}
+				fmt.Printf("  %v: seeders %d, leechers %d, completed %d\n",
+					names[string(infoHash)], res.Seeders, res.Leechers, res.Completed)
+			}
+		}
+	} else if command == "seed" {
+		args := os.Args[2:]
+		uploadSlots := torrent.DefaultUploadSlots
+		if len(args) == 4 && args[0] == "--upload-slots" {
+			n, err := strconv.Atoi(args[1])
+			exit_on_error(err)
+			uploadSlots = n
+			args = args[2:]
+		}
+		if len(args) != 2 {
+			fmt.Println("Expect: [--upload-slots n] torrent_file path")
+			os.Exit(1)
+		}
+		torrentFilename := args[0]
+		path := args[1]
 
 		bytes, err := os.ReadFile(torrentFilename)
 		exit_on_error(err)
 
-		torrent, err := parseTorrent(string(bytes))
+		t, err := torrent.Parse(bytes)
+		exit_on_error(err)
+
+		err = client.Seed(ctx, t, path, uploadSlots)
+		exit_on_error(err)
+	} else if command == "create" {
+		usage := "Expect: -o output_file [--tracker url[,url...]]... [--piece-length n] [--comment text] [--source tag] [--web-seed url]... [--private] path"
+		args := os.Args[2:]
+		if len(args) < 3 || args[0] != "-o" {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		outputFilename := args[1]
+		args = args[2:]
+
+		opts := torrent.CreateOptions{CreatedBy: peer.ClientVersion, CreationDate: time.Now()}
+		for len(args) > 1 {
+			option := args[0]
+			if option == "--private" {
+				opts.Private = true
+				args = args[1:]
+				continue
+			}
+
+			value := args[1]
+			switch option {
+			case "--tracker":
+				// Each --tracker is a tier, with the trackers of the tier
+				// separated by commas
+				opts.Trackers = append(opts.Trackers, strings.Split(value, ","))
+			case "--piece-length":
+				n, err := strconv.Atoi(value)
+				exit_on_error(err)
+				opts.PieceLength = n
+			case "--comment":
+				opts.Comment = value
+			case "--source":
+				opts.Source = value
+			case "--web-seed":
+				opts.WebSeeds = append(opts.WebSeeds, value)
+			default:
+				fmt.Println(usage)
+				os.Exit(1)
+			}
+			args = args[2:]
+		}
+		if len(args) != 1 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		path := args[0]
+
+		t, data, err := torrent.Create(ctx, path, &opts)
 		exit_on_error(err)
 
-		// err = torrent.downloadFile(outputFilename)
-		err = torrent.downloadFilePipelining(outputFilename)
+		err = os.WriteFile(outputFilename, data, 0644)
 		exit_on_error(err)
 
-		fmt.Printf("Downloaded %v to %v\n", torrent.info.name, outputFilename)
+		fmt.Printf("Created %v: %v pieces of %v bytes\n", outputFilename, t.NumPieces(), t.Info.PieceLength)
+		fmt.Printf("Info Hash: %s\n", hex.EncodeToString(t.InfoHash))
 	} else {
 		fmt.Println("Unknown command: " + command)
 		os.Exit(1)
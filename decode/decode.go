@@ -6,93 +6,378 @@ import (
 	"unicode"
 )
 
+// Default limits of the decoder, well above what torrent files, tracker
+// responses and DHT messages need
+const DefaultMaxDepth = 64
+const DefaultMaxStringLength = 64 * 1024 * 1024
+const DefaultMaxLength = 128 * 1024 * 1024
+
+// Checks and limits applied while decoding. Input from the network can be
+// hostile: the limits bound the recursion depth and the memory a value can
+// make us allocate. Malformed or truncated input is always rejected.
+type Config struct {
+	// Reject valid but non-canonical encodings: integers with leading zeros
+	// or -0, string lengths with leading zeros, and dicts with unsorted or
+	// duplicate keys. Otherwise the last of duplicate keys wins.
+	Strict bool
+	// Maximum nesting of lists and dicts, DefaultMaxDepth if 0
+	MaxDepth int
+	// Maximum length of a string, DefaultMaxStringLength if 0
+	MaxStringLength int
+	// Maximum length of a whole encoded value read by a Decoder,
+	// DefaultMaxLength if 0. Values decoded from memory are bounded by the
+	// input already.
+	MaxLength int
+}
+
+// Used by the package-level functions: not strict, default limits
+var DefaultConfig = Config{}
+
+// Malformed input, with the offset where decoding failed.
+type SyntaxError struct {
+	Offset  int    // offset of the error in the input
+	Msg     string // what's wrong
+	Context string // input from the offset on, truncated
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %v at offset %d near %q", e.Msg, e.Offset, e.Context)
+}
+
+// Bytes of input quoted in SyntaxError
+const syntaxErrorContext = 16
+
 func isDigit(c byte) bool {
 	return unicode.IsDigit(rune(c))
 }
 
-func decodeOneFrom(str string, start int) (interface{}, int, error) {
-	first_char := str[start]
+// The state of decoding str. Indices into str, such as the endIdx returned
+// by the decode methods, are absolute; offset is added to them for errors,
+// as str may be part of a larger stream.
+type decodeState struct {
+	config Config
+	str    string
+	offset int
+	depth  int
+}
 
-	if isDigit(first_char) {
-		// 5:hello -> hello
-		var colonIndex int
+func newDecodeState(config Config, str string) *decodeState {
+	if config.MaxDepth <= 0 {
+		config.MaxDepth = DefaultMaxDepth
+	}
+	if config.MaxStringLength <= 0 {
+		config.MaxStringLength = DefaultMaxStringLength
+	}
+	if config.MaxLength <= 0 {
+		config.MaxLength = DefaultMaxLength
+	}
+	return &decodeState{config: config, str: str}
+}
 
-		for i := start + 1; i < len(str); i++ {
-			if str[i] == ':' {
-				colonIndex = i
-				break
-			}
+func (s *decodeState) errorf(idx int, format string, args ...interface{}) error {
+	context := ""
+	if idx < len(s.str) {
+		context = s.str[idx:]
+		if len(context) > syntaxErrorContext {
+			context = context[:syntaxErrorContext]
 		}
+	}
+	return &SyntaxError{Offset: s.offset + idx, Msg: fmt.Sprintf(format, args...), Context: context}
+}
 
-		length, err := strconv.Atoi(str[start:colonIndex])
+// The byte at str[idx], or an error if the input ends before it
+func (s *decodeState) byteAt(idx int) (byte, error) {
+	if idx >= len(s.str) {
+		return 0, s.errorf(idx, "unexpected end of input")
+	}
+	return s.str[idx], nil
+}
+
+// Enter a list or dict starting at str[start]
+func (s *decodeState) enter(start int) error {
+	s.depth++
+	if s.depth > s.config.MaxDepth {
+		return s.errorf(start, "nesting deeper than %d", s.config.MaxDepth)
+	}
+	return nil
+}
+
+func (s *decodeState) leave() {
+	s.depth--
+}
+
+// 5:hello -> hello
+func (s *decodeState) decodeString(start int) (string, int, error) {
+	colonIndex := start
+	for {
+		c, err := s.byteAt(colonIndex)
 		if err != nil {
 			return "", 0, err
 		}
+		if c == ':' {
+			break
+		}
+		if !isDigit(c) {
+			return "", 0, s.errorf(colonIndex, "invalid character %q in string length", c)
+		}
+		colonIndex++
+	}
 
-		return str[colonIndex+1 : colonIndex+1+length], colonIndex + length, nil
-	} else if first_char == 'i' {
-		// i52e -> 52
-		var nonDigitIndex int
+	lengthText := s.str[start:colonIndex]
+	if s.config.Strict && len(lengthText) > 1 && lengthText[0] == '0' {
+		return "", 0, s.errorf(start, "string length with leading zero")
+	}
+	length, err := strconv.Atoi(lengthText)
+	if err != nil || length > s.config.MaxStringLength {
+		return "", 0, s.errorf(start, "string longer than %d", s.config.MaxStringLength)
+	}
+	if length > len(s.str)-colonIndex-1 {
+		return "", 0, s.errorf(start, "string of length %d past end of input", length)
+	}
 
-		for i := start + 1; i < len(str); i++ {
-			if str[i] == 'e' {
-				nonDigitIndex = i
-				break
-			}
+	return s.str[colonIndex+1 : colonIndex+1+length], colonIndex + length, nil
+}
+
+// The text of the integer starting at str[start], between the i and the e,
+// and the index of the e. The text is checked to be a valid integer.
+func (s *decodeState) decodeIntText(start int) (string, int, error) {
+	endIdx := start + 1
+	for {
+		c, err := s.byteAt(endIdx)
+		if err != nil {
+			return "", 0, err
+		}
+		if c == 'e' {
+			break
+		}
+		if !isDigit(c) && !(c == '-' && endIdx == start+1) {
+			return "", 0, s.errorf(endIdx, "invalid character %q in integer", c)
 		}
+		endIdx++
+	}
 
-		integer, err := strconv.Atoi(str[start+1 : nonDigitIndex])
-		return integer, nonDigitIndex, err
+	text := s.str[start+1 : endIdx]
+	digits := text
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return "", 0, s.errorf(start, "integer without digits")
+	}
+	if s.config.Strict && digits[0] == '0' && (len(digits) > 1 || len(text) > 1) {
+		return "", 0, s.errorf(start, "non-canonical integer %v", text)
+	}
+
+	return text, endIdx, nil
+}
+
+// i52e -> 52
+func (s *decodeState) decodeInt(start int) (int, int, error) {
+	text, endIdx, err := s.decodeIntText(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	integer, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, 0, s.errorf(start, "integer %v out of range", text)
+	}
+	return integer, endIdx, nil
+}
+
+// Decode the value starting at str[start]. Returns the value and the index of
+// its last byte.
+func (s *decodeState) decodeValue(start int) (interface{}, int, error) {
+	first_char, err := s.byteAt(start)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if isDigit(first_char) {
+		return s.decodeString(start)
+	} else if first_char == 'i' {
+		return s.decodeInt(start)
 	} else if first_char == 'l' {
 		// l5:helloi52ee -> ["hello", 52]
 		// l5:helloi52elee -> ["hello", 52, []]
 		// l5:helloi52el1:s2:ssi32eee -> ["hello", 52, ["s", "ss", 32]]
-		curr := start + 1
+		err := s.enter(start)
+		if err != nil {
+			return nil, 0, err
+		}
+
 		res := [](interface{}){}
+		curr := start + 1
+		for {
+			c, err := s.byteAt(curr)
+			if err != nil {
+				return nil, 0, err
+			}
+			if c == 'e' {
+				break
+			}
 
-		for str[curr] != 'e' {
-			decoded, endIdx, err := decodeOneFrom(str, curr)
+			decoded, endIdx, err := s.decodeValue(curr)
 			if err != nil {
-				return [](interface{}){}, 0, err
+				return nil, 0, err
 			}
 
 			res = append(res, decoded)
 			curr = endIdx + 1
 		}
 
+		s.leave()
 		return res, curr, nil
 	} else if first_char == 'd' {
-		res := map[string](interface{}){}
+		return s.decodeDict(start, nil)
+	}
 
-		curr := start + 1
-		for str[curr] != 'e' {
-			decoded, endIdx, err := decodeOneFrom(str, curr)
-			decoded_key, ok := decoded.(string)
-			if !ok || err != nil {
-				return [](interface{}){}, 0, err
-			}
+	return nil, 0, s.errorf(start, "invalid character %q at start of value", first_char)
+}
 
-			decoded_val, endIdx, err := decodeOneFrom(str, endIdx+1)
-			if err != nil {
-				return [](interface{}){}, 0, err
-			}
+// Iterate over the entries of the dict starting at str[start], calling fn with
+// each key and the index its value starts at. fn decodes the value and
+// returns the index of its last byte. Returns the index of the dict's e.
+func (s *decodeState) forEachEntry(start int, fn func(key string, valStart int) (int, error)) (int, error) {
+	err := s.enter(start)
+	if err != nil {
+		return 0, err
+	}
 
-			res[decoded_key] = decoded_val
-			curr = endIdx + 1
+	prevKey := ""
+	curr := start + 1
+	for {
+		c, err := s.byteAt(curr)
+		if err != nil {
+			return 0, err
+		}
+		if c == 'e' {
+			break
+		}
+		if !isDigit(c) {
+			return 0, s.errorf(curr, "dict key is not a string")
 		}
 
-		return res, curr, nil
+		key, endIdx, err := s.decodeString(curr)
+		if err != nil {
+			return 0, err
+		}
+		if s.config.Strict && curr > start+1 && key <= prevKey {
+			return 0, s.errorf(curr, "dict key %q unsorted or duplicate", key)
+		}
+		prevKey = key
+
+		endIdx, err = fn(key, endIdx+1)
+		if err != nil {
+			return 0, err
+		}
+		curr = endIdx + 1
 	}
 
-	return nil, 0, fmt.Errorf("unexpected case?")
+	s.leave()
+	return curr, nil
 }
 
-func Decode(str string) (interface{}, error) {
-	res, endIdx, err := decodeOneFrom(str, 0)
+// Decode the dictionary starting at str[start]. If spans is not nil, the span
+// of each value is recorded in it.
+func (s *decodeState) decodeDict(start int, spans map[string]Span) (interface{}, int, error) {
+	res := map[string](interface{}){}
+
+	endIdx, err := s.forEachEntry(start, func(key string, valStart int) (int, error) {
+		decoded_val, endIdx, err := s.decodeValue(valStart)
+		if err != nil {
+			return 0, err
+		}
 
-	if endIdx != len(str)-1 {
-		return [](interface{}){}, fmt.Errorf("didn't consume entire string?")
+		res[key] = decoded_val
+		if spans != nil {
+			spans[key] = Span{Start: valStart, End: endIdx + 1}
+		}
+		return endIdx, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return res, endIdx, nil
+}
+
+// Check that the value ending at str[endIdx] is all the input.
+func (s *decodeState) checkEnd(endIdx int) error {
+	if endIdx != len(s.str)-1 {
+		return s.errorf(endIdx+1, "data after value")
 	}
+	return nil
+}
+
+// The encoded value str[Start:End]
+type Span struct {
+	Start int
+	End   int
+}
+
+// Decode a dictionary and also return the span of each value in the input.
+// This gives the exact bytes of a value as they were encoded, e.g. the info
+// dictionary of a torrent, which must be hashed as is.
+func (c Config) DecodeDictWithSpans(str string) (map[string](interface{}), map[string]Span, error) {
+	s := newDecodeState(c, str)
+	if len(str) == 0 || str[0] != 'd' {
+		return nil, nil, s.errorf(0, "not a dictionary")
+	}
+
+	spans := map[string]Span{}
+	res, endIdx, err := s.decodeDict(0, spans)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.checkEnd(endIdx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return res.(map[string](interface{})), spans, nil
+}
 
-	return res, err
+// Decode the value at the start of str and return the number of bytes it
+// takes. Unlike Decode, data may follow the value, e.g. the metadata piece
+// following the dict in an ut_metadata data message.
+func (c Config) DecodePrefix(str string) (interface{}, int, error) {
+	s := newDecodeState(c, str)
+	res, endIdx, err := s.decodeValue(0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return res, endIdx + 1, nil
+}
+
+// Decode a single value taking all of str. Integers are decoded as int,
+// strings as string, lists as []interface{} and dicts as
+// map[string]interface{}.
+func (c Config) Decode(str string) (interface{}, error) {
+	s := newDecodeState(c, str)
+	res, endIdx, err := s.decodeValue(0)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkEnd(endIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// DecodeDictWithSpans with DefaultConfig
+func DecodeDictWithSpans(str string) (map[string](interface{}), map[string]Span, error) {
+	return DefaultConfig.DecodeDictWithSpans(str)
+}
+
+// DecodePrefix with DefaultConfig
+func DecodePrefix(str string) (interface{}, int, error) {
+	return DefaultConfig.DecodePrefix(str)
+}
+
+// Decode with DefaultConfig
+func Decode(str string) (interface{}, error) {
+	return DefaultConfig.Decode(str)
 }
@@ -0,0 +1,152 @@
+package decode
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// A Decoder reads consecutive encoded values from a stream, such as a
+// connection or an HTTP response body, without reading it whole first.
+type Decoder struct {
+	config Config
+	r      *bufio.Reader
+	offset int // offset in the stream of the next value
+}
+
+// The decoder buffers its reads, so it may read past the values it decodes;
+// Buffered returns those bytes. If r is a *bufio.Reader, the decoder reads
+// from it directly and nothing is left behind.
+func (c Config) NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{config: newDecodeState(c, "").config, r: bufio.NewReader(r)}
+}
+
+// NewDecoder with DefaultConfig
+func NewDecoder(r io.Reader) *Decoder {
+	return DefaultConfig.NewDecoder(r)
+}
+
+// Read the next value from the stream and store it in the value v points to,
+// as Unmarshal does. Returns io.EOF if the stream ends before the value
+// starts, io.ErrUnexpectedEOF if it ends within the value. Offsets in errors
+// are from the start of the stream.
+func (d *Decoder) Decode(v interface{}) error {
+	var buf bytes.Buffer
+	err := d.readValue(&buf, 0)
+	if err != nil {
+		if err == io.EOF && buf.Len() > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	offset := d.offset
+	d.offset += buf.Len()
+	return d.config.unmarshal(buf.String(), offset, v)
+}
+
+// The data read from the stream but not decoded yet.
+func (d *Decoder) Buffered() io.Reader {
+	data, _ := d.r.Peek(d.r.Buffered())
+	return bytes.NewReader(data)
+}
+
+// Integers and string lengths are 64 bits at most, so longer ones can't be
+// decoded anyway. Leading zeros are allowed unless strict, hence the margin.
+const maxIntLength = 64
+
+// Report a syntax error at the end of buf, i.e. at the last byte read
+func (d *Decoder) errorf(buf *bytes.Buffer, format string, args ...interface{}) error {
+	s := decodeState{str: buf.String(), offset: d.offset}
+	return s.errorf(buf.Len()-1, format, args...)
+}
+
+// Copy the encoded value at the head of the stream to buf. The value is only
+// scanned for its end and checked against the limits, Unmarshal checks the
+// rest. Returns io.EOF wherever the stream ends; Decode tells whether that's
+// within the value.
+func (d *Decoder) readValue(buf *bytes.Buffer, depth int) error {
+	// Checked before each value and string, so buf exceeds the limit by an
+	// integer and a few bytes at most
+	if buf.Len() >= d.config.MaxLength {
+		return d.errorf(buf, "value longer than %d", d.config.MaxLength)
+	}
+
+	first_char, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(first_char)
+
+	if isDigit(first_char) {
+		// 5:hello
+		length := int(first_char - '0')
+		for digits := 1; ; digits++ {
+			if digits > maxIntLength {
+				return d.errorf(buf, "string length longer than %d digits", maxIntLength)
+			}
+			c, err := d.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(c)
+			if c == ':' {
+				break
+			}
+			if !isDigit(c) {
+				return d.errorf(buf, "invalid character %q in string length", c)
+			}
+			length = length*10 + int(c-'0')
+			if length > d.config.MaxStringLength {
+				return d.errorf(buf, "string longer than %d", d.config.MaxStringLength)
+			}
+		}
+
+		if buf.Len()+length > d.config.MaxLength {
+			return d.errorf(buf, "value longer than %d", d.config.MaxLength)
+		}
+		_, err = io.CopyN(buf, d.r, int64(length))
+		return err
+	} else if first_char == 'i' {
+		// i52e
+		for digits := 0; ; digits++ {
+			if digits > maxIntLength {
+				return d.errorf(buf, "integer longer than %d digits", maxIntLength)
+			}
+			c, err := d.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(c)
+			if c == 'e' {
+				return nil
+			}
+			if !isDigit(c) && c != '-' {
+				return d.errorf(buf, "invalid character %q in integer", c)
+			}
+		}
+	} else if first_char == 'l' || first_char == 'd' {
+		// l<value>...e, d<key><value>...e
+		if depth >= d.config.MaxDepth {
+			return d.errorf(buf, "nesting deeper than %d", d.config.MaxDepth)
+		}
+		for {
+			c, err := d.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if c == 'e' {
+				buf.WriteByte(c)
+				return nil
+			}
+
+			d.r.UnreadByte()
+			err = d.readValue(buf, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.errorf(buf, "invalid character %q at start of value", first_char)
+}
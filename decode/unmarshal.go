@@ -0,0 +1,279 @@
+package decode
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// An encoded value. Unmarshal stores the exact bytes of the value in it, to be
+// decoded later or hashed, e.g. the info dict of a torrent. encode.Marshal
+// writes it as is.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// A value that can't be stored in a Go value of the given type, e.g. a list
+// for a string field.
+type UnmarshalTypeError struct {
+	Value  string // kind of the encoded value: string, integer, list or dict
+	Type   reflect.Type
+	Offset int // offset of the value in the input
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("cannot unmarshal %v into %v at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// Decode data into the value v points to. Dicts are decoded into structs and
+// maps with string keys, lists into slices, strings into strings and []byte,
+// integers into any integer type or bool. Pointers are allocated as needed.
+//
+// The dict key of a struct field is given by its tag, the field name if
+// there's none:
+//
+//	PieceLength int `bencode:"piece length"`
+//
+// Keys without a matching field are skipped. Fields tagged "-" and unexported
+// fields are ignored.
+func (c Config) Unmarshal(data []byte, v interface{}) error {
+	return c.unmarshal(string(data), 0, v)
+}
+
+// Unmarshal with DefaultConfig
+func Unmarshal(data []byte, v interface{}) error {
+	return DefaultConfig.Unmarshal(data, v)
+}
+
+// Unmarshal str, which starts at offset in the input, for errors.
+func (c Config) unmarshal(str string, offset int, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("unmarshal into non-pointer %T", v)
+	}
+
+	s := newDecodeState(c, str)
+	s.offset = offset
+	endIdx, err := s.unmarshalFrom(0, rv.Elem())
+	if err != nil {
+		return err
+	}
+
+	return s.checkEnd(endIdx)
+}
+
+func valueKind(c byte) string {
+	switch {
+	case isDigit(c):
+		return "string"
+	case c == 'i':
+		return "integer"
+	case c == 'l':
+		return "list"
+	case c == 'd':
+		return "dict"
+	}
+	return "invalid value"
+}
+
+// Decode the value starting at str[start] into v. Like decodeValue, returns
+// the index of the last byte of the value.
+func (s *decodeState) unmarshalFrom(start int, v reflect.Value) (int, error) {
+	first_char, err := s.byteAt(start)
+	if err != nil {
+		return 0, err
+	}
+
+	if v.Type() == rawMessageType {
+		_, endIdx, err := s.decodeValue(start)
+		if err != nil {
+			return 0, err
+		}
+		v.SetBytes([]byte(s.str[start : endIdx+1]))
+		return endIdx, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return s.unmarshalFrom(start, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			decoded, endIdx, err := s.decodeValue(start)
+			if err != nil {
+				return 0, err
+			}
+			v.Set(reflect.ValueOf(decoded))
+			return endIdx, nil
+		}
+	case reflect.String:
+		if isDigit(first_char) {
+			decoded, endIdx, err := s.decodeString(start)
+			if err != nil {
+				return 0, err
+			}
+			v.SetString(decoded)
+			return endIdx, nil
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && isDigit(first_char) {
+			decoded, endIdx, err := s.decodeString(start)
+			if err != nil {
+				return 0, err
+			}
+			v.SetBytes([]byte(decoded))
+			return endIdx, nil
+		}
+		if first_char == 'l' {
+			return s.unmarshalList(start, v)
+		}
+	case reflect.Array:
+		// Fixed-size binary strings, e.g. a [20]byte peer id
+		if v.Type().Elem().Kind() == reflect.Uint8 && isDigit(first_char) {
+			decoded, endIdx, err := s.decodeString(start)
+			if err != nil {
+				return 0, err
+			}
+			if len(decoded) != v.Len() {
+				return 0, &UnmarshalTypeError{Value: "string of length " + strconv.Itoa(len(decoded)), Type: v.Type(), Offset: s.offset + start}
+			}
+			reflect.Copy(v, reflect.ValueOf([]byte(decoded)))
+			return endIdx, nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if first_char == 'i' {
+			text, endIdx, err := s.decodeIntText(start)
+			if err != nil {
+				return 0, err
+			}
+			n, err := strconv.ParseInt(text, 10, 64)
+			if err != nil || v.OverflowInt(n) {
+				return 0, &UnmarshalTypeError{Value: "integer " + text, Type: v.Type(), Offset: s.offset + start}
+			}
+			v.SetInt(n)
+			return endIdx, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if first_char == 'i' {
+			text, endIdx, err := s.decodeIntText(start)
+			if err != nil {
+				return 0, err
+			}
+			n, err := strconv.ParseUint(text, 10, 64)
+			if err != nil || v.OverflowUint(n) {
+				return 0, &UnmarshalTypeError{Value: "integer " + text, Type: v.Type(), Offset: s.offset + start}
+			}
+			v.SetUint(n)
+			return endIdx, nil
+		}
+	case reflect.Bool:
+		// Flags such as private are integers, 1 for true
+		if first_char == 'i' {
+			text, endIdx, err := s.decodeIntText(start)
+			if err != nil {
+				return 0, err
+			}
+			v.SetBool(strings.TrimLeft(text, "-0") != "")
+			return endIdx, nil
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String && first_char == 'd' {
+			return s.unmarshalMap(start, v)
+		}
+	case reflect.Struct:
+		if first_char == 'd' {
+			return s.unmarshalStruct(start, v)
+		}
+	}
+
+	return 0, &UnmarshalTypeError{Value: valueKind(first_char), Type: v.Type(), Offset: s.offset + start}
+}
+
+// l<value>...e. The slice is replaced, not appended to.
+func (s *decodeState) unmarshalList(start int, v reflect.Value) (int, error) {
+	err := s.enter(start)
+	if err != nil {
+		return 0, err
+	}
+
+	res := reflect.MakeSlice(v.Type(), 0, 0)
+	curr := start + 1
+	for {
+		c, err := s.byteAt(curr)
+		if err != nil {
+			return 0, err
+		}
+		if c == 'e' {
+			break
+		}
+
+		elem := reflect.New(v.Type().Elem()).Elem()
+		endIdx, err := s.unmarshalFrom(curr, elem)
+		if err != nil {
+			return 0, err
+		}
+
+		res = reflect.Append(res, elem)
+		curr = endIdx + 1
+	}
+
+	s.leave()
+	v.Set(res)
+	return curr, nil
+}
+
+// d<key><value>...e into a map with string keys. Entries are added to the
+// map if it already exists.
+func (s *decodeState) unmarshalMap(start int, v reflect.Value) (int, error) {
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+
+	return s.forEachEntry(start, func(key string, valStart int) (int, error) {
+		elem := reflect.New(v.Type().Elem()).Elem()
+		endIdx, err := s.unmarshalFrom(valStart, elem)
+		if err != nil {
+			return 0, err
+		}
+
+		v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		return endIdx, nil
+	})
+}
+
+// d<key><value>...e into a struct, matching keys to fields by their tags.
+func (s *decodeState) unmarshalStruct(start int, v reflect.Value) (int, error) {
+	fields := structFields(v.Type())
+
+	return s.forEachEntry(start, func(key string, valStart int) (int, error) {
+		if index, ok := fields[key]; ok {
+			return s.unmarshalFrom(valStart, v.Field(index))
+		}
+		_, endIdx, err := s.decodeValue(valStart)
+		return endIdx, err
+	})
+}
+
+// The index of each field of a struct type by dict key. The key is the name
+// in the bencode tag, or the field name. Fields tagged "-" and unexported
+// fields are left out.
+func structFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("bencode")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = i
+	}
+	return fields
+}
@@ -0,0 +1,653 @@
+// Package dht implements a node of the Mainline DHT (BEP 5), used to find
+// peers of a torrent without a tracker.
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+)
+
+// Length of node ids and info hashes
+const IDLength = 20
+
+// Number of queries sent in parallel during a lookup
+const Alpha = 3
+
+const DefaultQueryTimeout = 2 * time.Second
+
+// Tokens for announce_peer are derived from a secret that changes every
+// TokenRotation. Tokens from the previous secret are accepted as well.
+const TokenRotation = 5 * time.Minute
+
+// Announced peers are forgotten after PeerTTL
+const PeerTTL = 30 * time.Minute
+
+// Maximum number of peers stored and returned per info hash
+const MaxPeersPerInfoHash = 100
+
+type Config struct {
+	// UDP address to listen on, e.g. ":6881"
+	Addr string
+	// Nodes to bootstrap from, as host:port
+	BootstrapNodes []string
+	// If set, the routing table is loaded from and saved to this file. An
+	// invalid file is renamed to StateFile + ".invalid" and replaced.
+	StateFile string
+	// Defaults to DefaultQueryTimeout
+	QueryTimeout time.Duration
+}
+
+type Node struct {
+	config Config
+	id     string
+	conn   *net.UDPConn
+	table  *routingTable
+
+	mu           sync.Mutex
+	transactions map[string]*transaction                 // queries waiting for a response, by transaction id
+	peers        map[string]map[netip.AddrPort]time.Time // announced peers by info hash
+	secret       []byte
+	prevSecret   []byte
+	secretTime   time.Time
+
+	done chan struct{}
+}
+
+// Create a node listening on config.Addr. The routing table is loaded from
+// config.StateFile if it exists. Call Bootstrap to join the network.
+func NewNode(config Config) (*Node, error) {
+	if config.QueryTimeout == 0 {
+		config.QueryTimeout = DefaultQueryTimeout
+	}
+
+	id := make([]byte, IDLength)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 16)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		config:       config,
+		id:           string(id),
+		transactions: make(map[string]*transaction),
+		peers:        make(map[string]map[netip.AddrPort]time.Time),
+		secret:       secret,
+		prevSecret:   secret,
+		secretTime:   time.Now(),
+		done:         make(chan struct{}),
+	}
+	n.table = newRoutingTable(n.id)
+
+	if config.StateFile != "" {
+		err = n.load(config.StateFile)
+		var invalid *invalidStateError
+		if errors.As(err, &invalid) {
+			// Start from a fresh routing table, keeping the file for
+			// inspection
+			err = os.Rename(config.StateFile, config.StateFile+".invalid")
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	n.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go n.serve()
+	return n, nil
+}
+
+func (n *Node) ID() []byte {
+	return []byte(n.id)
+}
+
+func (n *Node) Addr() netip.AddrPort {
+	return n.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// Number of nodes in the routing table
+func (n *Node) NumNodes() int {
+	return n.table.size()
+}
+
+// Stop the node, saving the routing table if config.StateFile is set.
+func (n *Node) Close() error {
+	close(n.done)
+	err := n.conn.Close()
+	if n.config.StateFile != "" {
+		saveErr := n.Save(n.config.StateFile)
+		if err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// Join the network: contact the bootstrap nodes and the nodes of a saved
+// routing table, then look up our own id to fill the routing table. Returns
+// early if ctx is cancelled.
+func (n *Node) Bootstrap(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, hostport := range n.config.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp", hostport)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(addr netip.AddrPort) {
+			defer wg.Done()
+			n.findNode(ctx, addr, n.id)
+		}(addr.AddrPort())
+	}
+	for _, c := range n.table.closest(n.id, K) {
+		wg.Add(1)
+		go func(c contact) {
+			defer wg.Done()
+			n.Ping(ctx, c.addr)
+		}(c)
+	}
+	wg.Wait()
+
+	n.lookup(ctx, n.id, false)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if n.table.size() == 0 {
+		return fmt.Errorf("dht: bootstrap failed, no node responded")
+	}
+	return nil
+}
+
+// Find peers of the torrent. If ctx is cancelled, the peers found so far are
+// returned with the context's error.
+func (n *Node) GetPeers(ctx context.Context, infoHash []byte) ([]netip.AddrPort, error) {
+	if len(infoHash) != IDLength {
+		return nil, fmt.Errorf("dht: invalid info hash")
+	}
+
+	peers, _ := n.lookup(ctx, string(infoHash), true)
+	return peers, ctx.Err()
+}
+
+// Announce that we're a peer of the torrent listening on port to the nodes
+// closest to the info hash. Returns the peers found on the way.
+func (n *Node) Announce(ctx context.Context, infoHash []byte, port int) ([]netip.AddrPort, error) {
+	if len(infoHash) != IDLength {
+		return nil, fmt.Errorf("dht: invalid info hash")
+	}
+
+	peers, closest := n.lookup(ctx, string(infoHash), true)
+	if ctx.Err() != nil {
+		return peers, ctx.Err()
+	}
+	announced := 0
+	for _, c := range closest {
+		if c.token == "" {
+			continue
+		}
+		_, err := n.query(ctx, c.addr, "announce_peer", map[string]interface{}{
+			"info_hash":    string(infoHash),
+			"port":         port,
+			"implied_port": 0,
+			"token":        c.token,
+		})
+		if err == nil {
+			announced++
+		}
+	}
+
+	if announced == 0 {
+		return peers, fmt.Errorf("dht: no node accepted the announce")
+	}
+	return peers, nil
+}
+
+func (n *Node) Ping(ctx context.Context, addr netip.AddrPort) error {
+	_, err := n.query(ctx, addr, "ping", map[string]interface{}{})
+	return err
+}
+
+func (n *Node) findNode(ctx context.Context, addr netip.AddrPort, target string) ([]contact, error) {
+	r, err := n.query(ctx, addr, "find_node", map[string]interface{}{"target": target})
+	if err != nil {
+		return nil, err
+	}
+	nodes, _ := r["nodes"].(string)
+	return decodeNodes(nodes), nil
+}
+
+// A node found during a lookup
+type lookupNode struct {
+	contact
+	queried bool
+	token   string // token from the node's get_peers response
+}
+
+// Iterative lookup of the nodes closest to the target, querying Alpha nodes at
+// a time until the K closest nodes known have all been queried. With getPeers,
+// get_peers queries are sent instead of find_node, and the peers found are
+// returned. Returns the K closest nodes that responded. The lookup stops early
+// when ctx is cancelled.
+func (n *Node) lookup(ctx context.Context, target string, getPeers bool) ([]netip.AddrPort, []lookupNode) {
+	var mu sync.Mutex
+	candidates := make(map[string]*lookupNode)
+	responded := make(map[string]bool)
+	peers := make([]netip.AddrPort, 0)
+	seenPeers := make(map[netip.AddrPort]bool)
+
+	addCandidates := func(contacts []contact) {
+		for _, c := range contacts {
+			if _, ok := candidates[c.id]; !ok && c.id != n.id {
+				candidates[c.id] = &lookupNode{contact: c}
+			}
+		}
+	}
+	addCandidates(n.table.closest(target, K))
+
+	for {
+		// The closest candidates not queried yet, among the K closest
+		mu.Lock()
+		sorted := make([]contact, 0, len(candidates))
+		for _, c := range candidates {
+			sorted = append(sorted, c.contact)
+		}
+		sortByDistance(sorted, target)
+		toQuery := make([]*lookupNode, 0, Alpha)
+		for i := 0; i < len(sorted) && i < K && len(toQuery) < Alpha; i++ {
+			c := candidates[sorted[i].id]
+			if !c.queried {
+				c.queried = true
+				toQuery = append(toQuery, c)
+			}
+		}
+		mu.Unlock()
+
+		if len(toQuery) == 0 || ctx.Err() != nil {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range toQuery {
+			wg.Add(1)
+			go func(c *lookupNode) {
+				defer wg.Done()
+
+				var r map[string]interface{}
+				var err error
+				if getPeers {
+					r, err = n.query(ctx, c.addr, "get_peers", map[string]interface{}{"info_hash": target})
+				} else {
+					r, err = n.query(ctx, c.addr, "find_node", map[string]interface{}{"target": target})
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					// Failed nodes don't count as the closest
+					delete(candidates, c.id)
+					return
+				}
+				responded[c.id] = true
+				c.token, _ = r["token"].(string)
+				nodes, _ := r["nodes"].(string)
+				addCandidates(decodeNodes(nodes))
+				values, _ := r["values"].([]interface{})
+				for _, peer := range decodePeers(values) {
+					if !seenPeers[peer] {
+						seenPeers[peer] = true
+						peers = append(peers, peer)
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	closest := make([]contact, 0)
+	for id := range responded {
+		closest = append(closest, candidates[id].contact)
+	}
+	sortByDistance(closest, target)
+	if len(closest) > K {
+		closest = closest[:K]
+	}
+	res := make([]lookupNode, 0, len(closest))
+	for _, c := range closest {
+		res = append(res, *candidates[c.id])
+	}
+	return peers, res
+}
+
+// Length of our transaction ids. They're random, so that responses can't be
+// forged by guessing them.
+const tidLength = 4
+
+// A query waiting for its response, which must come from the queried address
+type transaction struct {
+	addr netip.AddrPort
+	ch   chan *krpcMsg
+}
+
+// Send a query and wait for the response. Returns the return values of the
+// response.
+func (n *Node) query(ctx context.Context, addr netip.AddrPort, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = n.id
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	ch := make(chan *krpcMsg, 1)
+	tidBytes := make([]byte, tidLength)
+	n.mu.Lock()
+	var tid string
+	for {
+		_, err := rand.Read(tidBytes)
+		if err != nil {
+			n.mu.Unlock()
+			return nil, err
+		}
+		tid = string(tidBytes)
+		if _, ok := n.transactions[tid]; !ok {
+			break
+		}
+	}
+	n.transactions[tid] = &transaction{addr: addr, ch: ch}
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.transactions, tid)
+		n.mu.Unlock()
+	}()
+
+	packet, err := encodeMsg(&krpcMsg{t: tid, y: "q", q: method, a: args})
+	if err != nil {
+		return nil, err
+	}
+	_, err = n.conn.WriteToUDPAddrPort(packet, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(n.config.QueryTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-ch:
+		if msg.y == "e" {
+			return nil, fmt.Errorf("dht: %v returned error %v", addr, msg.e)
+		}
+		id, _ := msg.r["id"].(string)
+		n.table.update(id, addr)
+		return msg.r, nil
+	case <-timer.C:
+		n.failed(addr)
+		return nil, fmt.Errorf("dht: %v timed out", addr)
+	case <-n.done:
+		return nil, fmt.Errorf("dht: node closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Record a timeout of the node at addr in the routing table.
+func (n *Node) failed(addr netip.AddrPort) {
+	for _, c := range n.table.closest(n.id, 8*IDLength*K) {
+		if c.addr == addr {
+			n.table.failed(c.id)
+		}
+	}
+}
+
+// Read and dispatch incoming messages until the node is closed.
+func (n *Node) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		size, addr, err := n.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			select {
+			case <-n.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		packet := make([]byte, size)
+		copy(packet, buf[:size])
+		n.handlePacket(packet, netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()))
+	}
+}
+
+func (n *Node) handlePacket(packet []byte, addr netip.AddrPort) {
+	msg, err := decodeMsg(packet)
+	if err != nil {
+		return
+	}
+
+	if msg.y == "q" {
+		n.handleQuery(msg, addr)
+		return
+	}
+
+	// Responses from another address than the one queried are dropped, as
+	// anyone could send them
+	n.mu.Lock()
+	t, ok := n.transactions[msg.t]
+	n.mu.Unlock()
+	if ok && t.addr == addr {
+		select {
+		case t.ch <- msg:
+		default:
+		}
+	}
+}
+
+func (n *Node) handleQuery(msg *krpcMsg, addr netip.AddrPort) {
+	id, ok := msg.a["id"].(string)
+	if !ok || len(id) != IDLength {
+		n.sendError(msg.t, addr, errProtocol, "invalid id")
+		return
+	}
+
+	r := map[string]interface{}{"id": n.id}
+	switch msg.q {
+	case "ping":
+	case "find_node":
+		target, _ := msg.a["target"].(string)
+		if len(target) != IDLength {
+			n.sendError(msg.t, addr, errProtocol, "invalid target")
+			return
+		}
+		r["nodes"] = encodeNodes(n.table.closest(target, K))
+	case "get_peers":
+		infoHash, _ := msg.a["info_hash"].(string)
+		if len(infoHash) != IDLength {
+			n.sendError(msg.t, addr, errProtocol, "invalid info_hash")
+			return
+		}
+		r["token"] = n.token(addr.Addr(), false)
+		if peers := n.storedPeers(infoHash); len(peers) > 0 {
+			r["values"] = encodePeers(peers)
+		} else {
+			r["nodes"] = encodeNodes(n.table.closest(infoHash, K))
+		}
+	case "announce_peer":
+		infoHash, _ := msg.a["info_hash"].(string)
+		token, _ := msg.a["token"].(string)
+		port, _ := msg.a["port"].(int)
+		if implied, _ := msg.a["implied_port"].(int); implied != 0 {
+			port = int(addr.Port())
+		}
+		if len(infoHash) != IDLength || port <= 0 || port > 65535 {
+			n.sendError(msg.t, addr, errProtocol, "invalid arguments")
+			return
+		}
+		if token != n.token(addr.Addr(), false) && token != n.token(addr.Addr(), true) {
+			n.sendError(msg.t, addr, errProtocol, "bad token")
+			return
+		}
+		n.storePeer(infoHash, netip.AddrPortFrom(addr.Addr(), uint16(port)))
+	default:
+		n.sendError(msg.t, addr, errMethodUnknown, "method unknown")
+		return
+	}
+
+	n.table.update(id, addr)
+	packet, err := encodeMsg(&krpcMsg{t: msg.t, y: "r", r: r})
+	if err != nil {
+		return
+	}
+	n.conn.WriteToUDPAddrPort(packet, addr)
+}
+
+func (n *Node) sendError(tid string, addr netip.AddrPort, code int, message string) {
+	packet, err := encodeMsg(&krpcMsg{t: tid, y: "e", e: []interface{}{code, message}})
+	if err != nil {
+		return
+	}
+	n.conn.WriteToUDPAddrPort(packet, addr)
+}
+
+// Token for announce_peer given to the IP in get_peers responses: a hash of
+// the IP and a secret. With previous, the token from the previous secret.
+func (n *Node) token(ip netip.Addr, previous bool) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if time.Since(n.secretTime) > TokenRotation {
+		secret := make([]byte, 16)
+		rand.Read(secret)
+		n.prevSecret = n.secret
+		n.secret = secret
+		n.secretTime = time.Now()
+	}
+
+	secret := n.secret
+	if previous {
+		secret = n.prevSecret
+	}
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(ip.AsSlice())
+	return string(h.Sum(nil)[:8])
+}
+
+func (n *Node) storePeer(infoHash string, peer netip.AddrPort) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	peers, ok := n.peers[infoHash]
+	if !ok {
+		peers = make(map[netip.AddrPort]time.Time)
+		n.peers[infoHash] = peers
+	}
+	if _, ok := peers[peer]; ok || len(peers) < MaxPeersPerInfoHash {
+		peers[peer] = time.Now()
+	}
+}
+
+func (n *Node) storedPeers(infoHash string) []netip.AddrPort {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	res := make([]netip.AddrPort, 0)
+	for peer, announcedAt := range n.peers[infoHash] {
+		if time.Since(announcedAt) > PeerTTL {
+			delete(n.peers[infoHash], peer)
+			continue
+		}
+		res = append(res, peer)
+	}
+	return res
+}
+
+// The saved state of a node:
+// d2:id20:<id>5:nodes<compact node info>e
+type savedState struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+// Save our id and the routing table, so the next run can rejoin the network
+// without the bootstrap nodes.
+func (n *Node) Save(filename string) error {
+	tmpFilename := filename + ".tmp"
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+
+	err = encode.NewEncoder(f).Encode(savedState{
+		ID:    n.id,
+		Nodes: encodeNodes(n.table.closest(n.id, 8*IDLength*K)),
+	})
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// The state file exists but can't be loaded
+type invalidStateError struct {
+	err error
+}
+
+func (e *invalidStateError) Error() string {
+	return fmt.Sprintf("dht: invalid state file: %v", e.err)
+}
+
+func (e *invalidStateError) Unwrap() error {
+	return e.err
+}
+
+func (n *Node) load(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var state savedState
+	err = decode.NewDecoder(f).Decode(&state)
+	if err != nil {
+		return &invalidStateError{err}
+	}
+	id := state.ID
+	if len(id) != IDLength {
+		return &invalidStateError{fmt.Errorf("invalid id")}
+	}
+
+	n.id = id
+	n.table = newRoutingTable(id)
+	for _, c := range decodeNodes(state.Nodes) {
+		n.table.addUnverified(c.id, c.addr)
+	}
+	return nil
+}
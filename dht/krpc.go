@@ -0,0 +1,142 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+)
+
+// KRPC messages are bencoded dicts sent over UDP:
+// - t: transaction id, echoed in the response
+// - y: message type, "q" for query, "r" for response, "e" for error
+// - q, a: method name and arguments of a query
+// - r: return values of a response
+// - e: list of error code and message
+type krpcMsg struct {
+	t string
+	y string
+	q string
+	a map[string]interface{}
+	r map[string]interface{}
+	e []interface{}
+}
+
+// KRPC error codes
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// Length of a node in compact node info: 20-byte id, 4-byte IP, 2-byte port
+const compactNodeLength = IDLength + 6
+
+func encodeMsg(msg *krpcMsg) ([]byte, error) {
+	dict := map[string]interface{}{
+		"t": msg.t,
+		"y": msg.y,
+	}
+	switch msg.y {
+	case "q":
+		dict["q"] = msg.q
+		dict["a"] = msg.a
+	case "r":
+		dict["r"] = msg.r
+	case "e":
+		dict["e"] = msg.e
+	}
+
+	encoded, err := encode.Encode(dict)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encoded), nil
+}
+
+func decodeMsg(packet []byte) (*krpcMsg, error) {
+	decoded, err := decode.Decode(string(packet))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("message is not a dict")
+	}
+
+	msg := krpcMsg{}
+	msg.t, _ = dict["t"].(string)
+	msg.y, _ = dict["y"].(string)
+	msg.q, _ = dict["q"].(string)
+	msg.a, _ = dict["a"].(map[string]interface{})
+	msg.r, _ = dict["r"].(map[string]interface{})
+	msg.e, _ = dict["e"].([]interface{})
+
+	switch {
+	case msg.y == "q" && msg.a != nil:
+	case msg.y == "r" && msg.r != nil:
+	case msg.y == "e":
+	default:
+		return nil, fmt.Errorf("invalid message type: %q", msg.y)
+	}
+	return &msg, nil
+}
+
+// Encode nodes in compact node info format. Only IPv4 nodes are included.
+func encodeNodes(contacts []contact) string {
+	res := make([]byte, 0, len(contacts)*compactNodeLength)
+	for _, c := range contacts {
+		addr := c.addr.Addr().Unmap()
+		if !addr.Is4() {
+			continue
+		}
+		ip := addr.As4()
+		res = append(res, c.id...)
+		res = append(res, ip[:]...)
+		res = append(res, byte(c.addr.Port()>>8), byte(c.addr.Port()))
+	}
+	return string(res)
+}
+
+func decodeNodes(nodes string) []contact {
+	res := make([]contact, 0, len(nodes)/compactNodeLength)
+	for i := 0; i+compactNodeLength <= len(nodes); i += compactNodeLength {
+		id := nodes[i : i+IDLength]
+		ip := [4]byte{nodes[i+20], nodes[i+21], nodes[i+22], nodes[i+23]}
+		port := binary.BigEndian.Uint16([]byte(nodes[i+24 : i+26]))
+		res = append(res, contact{id: id, addr: netip.AddrPortFrom(netip.AddrFrom4(ip), port)})
+	}
+	return res
+}
+
+// Peers in get_peers responses are a list of 6-byte strings: 4-byte IP, 2-byte
+// port.
+func encodePeers(peers []netip.AddrPort) []interface{} {
+	res := make([]interface{}, 0, len(peers))
+	for _, peer := range peers {
+		addr := peer.Addr().Unmap()
+		if !addr.Is4() {
+			continue
+		}
+		ip := addr.As4()
+		res = append(res, string(append(ip[:], byte(peer.Port()>>8), byte(peer.Port()))))
+	}
+	return res
+}
+
+func decodePeers(values []interface{}) []netip.AddrPort {
+	res := make([]netip.AddrPort, 0, len(values))
+	for _, value_raw := range values {
+		value, ok := value_raw.(string)
+		if !ok || len(value) != 6 {
+			continue
+		}
+		ip := [4]byte{value[0], value[1], value[2], value[3]}
+		port := binary.BigEndian.Uint16([]byte(value[4:6]))
+		res = append(res, netip.AddrPortFrom(netip.AddrFrom4(ip), port))
+	}
+	return res
+}
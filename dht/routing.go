@@ -0,0 +1,191 @@
+package dht
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of nodes in a bucket, and in the results of a lookup
+const K = 8
+
+// A node that hasn't been heard from for this long is questionable and can be
+// replaced by a new node
+const NodeStaleAfter = 15 * time.Minute
+
+// A node that fails to respond this many times in a row is removed
+const MaxNodeFailures = 3
+
+type contact struct {
+	id       string // 20-byte node id
+	addr     netip.AddrPort
+	lastSeen time.Time
+	failures int
+}
+
+func (c *contact) isGood() bool {
+	return c.failures == 0 && time.Since(c.lastSeen) < NodeStaleAfter
+}
+
+// Routing table with one bucket per length of the common prefix with our own
+// id. Nodes in a bucket are ordered by the time they were last seen, the most
+// recently seen last.
+type routingTable struct {
+	mu      sync.Mutex
+	self    string
+	buckets [8 * IDLength][]*contact
+}
+
+func newRoutingTable(self string) *routingTable {
+	return &routingTable{self: self}
+}
+
+// Index of the bucket the id belongs to: the length of the common prefix of the
+// id and our id, in bits. Returns -1 for our own id.
+func (table *routingTable) bucketIndex(id string) int {
+	for i := 0; i < IDLength; i++ {
+		x := table.self[i] ^ id[i]
+		if x == 0 {
+			continue
+		}
+		prefix := 0
+		for x&0x80 == 0 {
+			x <<= 1
+			prefix++
+		}
+		return i*8 + prefix
+	}
+	return -1
+}
+
+// Record that we heard from the node. A new node is added if its bucket has
+// room, or if it can replace a node that is no longer good.
+func (table *routingTable) update(id string, addr netip.AddrPort) {
+	if len(id) != IDLength {
+		return
+	}
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	idx := table.bucketIndex(id)
+	if idx < 0 {
+		return
+	}
+	bucket := table.buckets[idx]
+
+	for i, c := range bucket {
+		if c.id == id {
+			c.addr = addr
+			c.lastSeen = time.Now()
+			c.failures = 0
+			bucket = append(append(bucket[:i:i], bucket[i+1:]...), c)
+			table.buckets[idx] = bucket
+			return
+		}
+	}
+
+	c := &contact{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < K {
+		table.buckets[idx] = append(bucket, c)
+		return
+	}
+	for i, old := range bucket {
+		if !old.isGood() {
+			table.buckets[idx] = append(append(bucket[:i:i], bucket[i+1:]...), c)
+			return
+		}
+	}
+}
+
+// Add a node we haven't heard from yet, e.g. loaded from a saved routing
+// table. Unlike update, it never replaces another node.
+func (table *routingTable) addUnverified(id string, addr netip.AddrPort) {
+	if len(id) != IDLength {
+		return
+	}
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	idx := table.bucketIndex(id)
+	if idx < 0 || len(table.buckets[idx]) >= K {
+		return
+	}
+	for _, c := range table.buckets[idx] {
+		if c.id == id {
+			return
+		}
+	}
+	table.buckets[idx] = append(table.buckets[idx], &contact{id: id, addr: addr})
+}
+
+// Record that the node didn't respond. It is removed after MaxNodeFailures
+// failures in a row.
+func (table *routingTable) failed(id string) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	idx := table.bucketIndex(id)
+	if idx < 0 {
+		return
+	}
+	bucket := table.buckets[idx]
+	for i, c := range bucket {
+		if c.id == id {
+			c.failures++
+			if c.failures >= MaxNodeFailures {
+				table.buckets[idx] = append(bucket[:i:i], bucket[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// The n nodes closest to the target.
+func (table *routingTable) closest(target string, n int) []contact {
+	table.mu.Lock()
+	all := make([]contact, 0)
+	for _, bucket := range table.buckets {
+		for _, c := range bucket {
+			all = append(all, *c)
+		}
+	}
+	table.mu.Unlock()
+
+	sortByDistance(all, target)
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (table *routingTable) size() int {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	n := 0
+	for _, bucket := range table.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// Whether a is closer to the target than b by XOR distance.
+func closer(a string, b string, target string) bool {
+	for i := 0; i < IDLength; i++ {
+		da := a[i] ^ target[i]
+		db := b[i] ^ target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+func sortByDistance(contacts []contact, target string) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return closer(contacts[i].id, contacts[j].id, target)
+	})
+}
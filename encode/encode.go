@@ -1,72 +1,59 @@
 package encode
 
 import (
+	"bufio"
 	"fmt"
-	"sort"
-	"strings"
+	"io"
+	"reflect"
 )
 
-func encodeInt(sb *strings.Builder, i int) error {
+// Where values are encoded to: a strings.Builder, or a bufio.Writer for an
+// Encoder
+type writer interface {
+	io.Writer
+	io.StringWriter
+}
+
+func encodeInt(sb writer, i int) error {
 	_, err := sb.WriteString(fmt.Sprintf("i%de", i))
 	return err
 }
 
-func encodeString(sb *strings.Builder, s string) error {
+func encodeString(sb writer, s string) error {
 	_, err := sb.WriteString(fmt.Sprintf("%d:%s", len(s), s))
 	return err
 }
 
-func encode(sb *strings.Builder, v interface{}) error {
-	switch v := v.(type) {
-	case int:
-		return encodeInt(sb, v)
-	case string:
-		return encodeString(sb, v)
-	case []interface{}:
-		sb.WriteString("l")
-		for _, e := range v {
-			err := encode(sb, e)
-			if err != nil {
-				return err
-			}
-		}
-		sb.WriteString("e")
-	case map[string]interface{}:
-		sb.WriteString("d")
-
-		// sort keys
-		keys := make([]string, 0)
-		for k := range v {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
-
-		for _, k := range keys {
-			err := encode(sb, k)
-			if err != nil {
-				return err
-			}
-			err = encode(sb, v[k])
-			if err != nil {
-				return err
-			}
-		}
-		sb.WriteString("e")
-	default:
-		return fmt.Errorf("encode: unhandled case")
+// Encode a value as produced by decode.Decode: int, string, []interface{} or
+// map[string]interface{}. Other types are encoded as by Marshal.
+func Encode(v interface{}) (string, error) {
+	encoded, err := Marshal(v)
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	return string(encoded), nil
 }
 
-func Encode(v interface{}) (string, error) {
-	var sb strings.Builder
+// An Encoder writes encoded values to a stream, such as a file or a
+// connection, without building them in memory first.
+type Encoder struct {
+	out io.Writer
+	w   *bufio.Writer
+}
 
-	err := encode(&sb, v)
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{out: w, w: bufio.NewWriter(w)}
+}
 
+// Write the encoding of v, as returned by Marshal, to the stream. Nothing is
+// buffered once Encode returns. If v can't be encoded, the part of it still
+// buffered is dropped, but a large value may have been partly written.
+func (e *Encoder) Encode(v interface{}) error {
+	err := marshal(e.w, reflect.ValueOf(v))
 	if err != nil {
-		return "", err
+		e.w.Reset(e.out)
+		return err
 	}
-
-	return sb.String(), nil
+	return e.w.Flush()
 }
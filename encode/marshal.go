@@ -0,0 +1,176 @@
+package encode
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+)
+
+var rawMessageType = reflect.TypeOf(decode.RawMessage(nil))
+
+// Return the encoding of v, the inverse of decode.Unmarshal. Structs and maps
+// with string keys are encoded as dicts with sorted keys, slices and arrays as
+// lists, strings, []byte and byte arrays as strings, integers as integers and
+// bools as 1 or 0. A decode.RawMessage is written as is.
+//
+// Struct fields are keyed as described for decode.Unmarshal. A field tagged
+// with omitempty, e.g. `bencode:"comment,omitempty"`, is left out when it has
+// its zero value or is empty. Nil pointers and interfaces have no encoding,
+// so fields holding them are always left out.
+func Marshal(v interface{}) ([]byte, error) {
+	var sb strings.Builder
+
+	err := marshal(&sb, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(sb.String()), nil
+}
+
+func marshal(sb writer, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("encode: nil value")
+	}
+
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("encode: empty RawMessage")
+		}
+		sb.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("encode: nil %v", v.Type())
+		}
+		return marshal(sb, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return encodeInt(sb, 1)
+		}
+		return encodeInt(sb, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		sb.WriteString("i" + strconv.FormatInt(v.Int(), 10) + "e")
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		sb.WriteString("i" + strconv.FormatUint(v.Uint(), 10) + "e")
+	case reflect.String:
+		return encodeString(sb, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			bytes := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(bytes), v)
+			return encodeString(sb, string(bytes))
+		}
+
+		sb.WriteString("l")
+		for i := 0; i < v.Len(); i++ {
+			err := marshal(sb, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		sb.WriteString("e")
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("encode: unsupported map key type %v", v.Type().Key())
+		}
+
+		// sort keys
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+		sb.WriteString("d")
+		for _, k := range keys {
+			err := encodeString(sb, k.String())
+			if err != nil {
+				return err
+			}
+			err = marshal(sb, v.MapIndex(k))
+			if err != nil {
+				return err
+			}
+		}
+		sb.WriteString("e")
+	case reflect.Struct:
+		sb.WriteString("d")
+		for _, field := range structFields(v.Type()) {
+			fv := v.Field(field.index)
+			if isNil(fv) || (field.omitEmpty && isEmpty(fv)) {
+				continue
+			}
+
+			err := encodeString(sb, field.name)
+			if err != nil {
+				return err
+			}
+			err = marshal(sb, fv)
+			if err != nil {
+				return err
+			}
+		}
+		sb.WriteString("e")
+	default:
+		return fmt.Errorf("encode: unsupported type %v", v.Type())
+	}
+
+	return nil
+}
+
+// An encoded struct field
+type field struct {
+	name      string // dict key
+	index     int
+	omitEmpty bool
+}
+
+// The encoded fields of a struct type, sorted by key. Fields are keyed as in
+// decode.Unmarshal.
+func structFields(t reflect.Type) []field {
+	fields := make([]field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("bencode")
+		if !sf.IsExported() || tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{name: name, index: i, omitEmpty: opts == "omitempty"})
+	}
+
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	return fields
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	// An empty RawMessage has no encoding either
+	return v.Type() == rawMessageType && v.Len() == 0
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	}
+	return false
+}
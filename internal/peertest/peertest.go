@@ -0,0 +1,54 @@
+// Package peertest provides peer connections over the loopback interface for
+// tests.
+package peertest
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+// Connect two peers of a torrent with numPieces pieces over the loopback
+// interface. Returns our side, which dialed, and the remote side. Both are
+// closed when the test ends.
+func Connect(t testing.TB, numPieces int) (*peer.Conn, *peer.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	infoHash := make([]byte, 20)
+	accepted := make(chan *peer.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		pc, err := peer.Accept(conn, infoHash, numPieces, peer.Config{})
+		if err != nil {
+			conn.Close()
+		}
+		accepted <- pc
+	}()
+
+	addr := netip.MustParseAddrPort(listener.Addr().String())
+	pc, err := peer.Dial(context.Background(), addr, infoHash, numPieces, peer.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+	if remote == nil {
+		pc.Close()
+		t.Fatal("Failed to accept connection")
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		remote.Close()
+	})
+	return pc, remote
+}
@@ -0,0 +1,145 @@
+package peerwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Messages longer than this are rejected. The largest messages are piece
+// messages with 16 KiB blocks, and bitfields of torrents with many pieces.
+const DefaultMaxLength = 1024 * 1024
+
+var ErrTooLong = errors.New("message too long")
+
+// Reads messages from a connection.
+//
+// A message whose read fails, e.g. because a read deadline expires, is kept
+// and the next call to ReadMessage continues where the failed read stopped, so
+// the stream stays in sync across timeouts.
+type Reader struct {
+	r         io.Reader
+	MaxLength int
+
+	header [4]byte
+	body   []byte
+	n      int // bytes of the current message read so far, including the length prefix
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, MaxLength: DefaultMaxLength}
+}
+
+// Read the next message.
+func (r *Reader) ReadMessage() (Message, error) {
+	for r.n < 4 {
+		k, err := r.r.Read(r.header[r.n:])
+		r.n += k
+		if r.n < 4 && err != nil {
+			return nil, err
+		}
+	}
+
+	length := int(binary.BigEndian.Uint32(r.header[:]))
+	if length > r.MaxLength {
+		return nil, fmt.Errorf("%w: %v bytes", ErrTooLong, length)
+	}
+	if r.body == nil {
+		r.body = make([]byte, length)
+	}
+	for r.n < 4+length {
+		k, err := r.r.Read(r.body[r.n-4:])
+		r.n += k
+		if r.n < 4+length && err != nil {
+			return nil, err
+		}
+	}
+
+	body := r.body
+	r.body = nil
+	r.n = 0
+	return Unmarshal(body)
+}
+
+// Writes messages to a connection. It's safe to write messages from multiple
+// goroutines.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) WriteMessage(msg Message) error {
+	buf := Marshal(msg)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.w.Write(buf)
+	return err
+}
+
+// Read messages and pass them to handle in the order they arrive, until
+// reading fails or handle returns an error, which is then returned.
+func Dispatch(r *Reader, handle func(msg Message) error) error {
+	for {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			return err
+		}
+		err = handle(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The protocol string of the handshake. Don't capitalize "protocol".
+const Protocol = "BitTorrent protocol"
+
+// Length of a handshake message
+const HandshakeLength = 68
+
+var ErrInvalidHandshake = errors.New("invalid handshake")
+
+// Handshake, the first message sent by both sides:
+// - 1-byte protocol string length (19)
+// - 19-byte protocol string
+// - 8 reserved bytes, signaling protocol extensions
+// - 20-byte info hash
+// - 20-byte peer id
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+func (h *Handshake) Marshal() []byte {
+	buf := make([]byte, 0, HandshakeLength)
+	buf = append(buf, byte(len(Protocol)))
+	buf = append(buf, Protocol...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash[:]...)
+	return append(buf, h.PeerID[:]...)
+}
+
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	buf := make([]byte, HandshakeLength)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != byte(len(Protocol)) || string(buf[1:20]) != Protocol {
+		return nil, fmt.Errorf("%w: unknown protocol", ErrInvalidHandshake)
+	}
+
+	h := Handshake{}
+	copy(h.Reserved[:], buf[20:28])
+	copy(h.InfoHash[:], buf[28:48])
+	copy(h.PeerID[:], buf[48:68])
+	return &h, nil
+}
@@ -0,0 +1,263 @@
+// Package peerwire implements the framing of the peer wire protocol (BEP 3):
+// the handshake and the length-prefixed messages exchanged after it.
+package peerwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Message ids
+const (
+	IDChoke         = 0
+	IDUnchoke       = 1
+	IDInterested    = 2
+	IDNotInterested = 3
+	IDHave          = 4
+	IDBitfield      = 5
+	IDRequest       = 6
+	IDPiece         = 7
+	IDCancel        = 8
+	IDPort          = 9  // DHT port (BEP 5)
+	IDExtended      = 20 // extension protocol (BEP 10)
+)
+
+// Returned for messages whose payload doesn't match their id, e.g. a have
+// message that isn't 4 bytes long.
+var ErrMalformed = errors.New("malformed message")
+
+// A message of the peer wire protocol. Messages are one of the types of this
+// package, and are used as values, e.g. Have{Index: 1}.
+type Message interface {
+	// Append the message, including its length prefix, to buf.
+	appendTo(buf []byte) []byte
+}
+
+// Sent when there's nothing else to send, to keep the connection open. It's
+// just a zero length prefix.
+type KeepAlive struct{}
+
+type Choke struct{}
+
+type Unchoke struct{}
+
+type Interested struct{}
+
+type NotInterested struct{}
+
+type Have struct {
+	Index uint32
+}
+
+// Pieces the sender has. The high bit of the first byte corresponds to piece
+// 0.
+type Bitfield struct {
+	Bits []byte
+}
+
+// Request for a block: Length bytes at offset Begin of piece Index.
+type Request struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+type Piece struct {
+	Index uint32
+	Begin uint32
+	Block []byte
+}
+
+// Cancel a previous request, with the same fields.
+type Cancel struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// The UDP port of the sender's DHT node.
+type Port struct {
+	Port uint16
+}
+
+// Message of the extension protocol. ExtendedID 0 is the extension
+// handshake, other ids are assigned in the handshake.
+type Extended struct {
+	ExtendedID uint8
+	Payload    []byte
+}
+
+// A message with an id this package doesn't know. It's returned rather than
+// treated as an error so that unknown extensions can be ignored.
+type Unknown struct {
+	ID      uint8
+	Payload []byte
+}
+
+// Each message is encoded as:
+// - 4-byte length of the rest of the message (0 for keep-alive)
+// - 1-byte message id
+// - payload
+func appendHeader(buf []byte, id uint8, payloadLen int) []byte {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(1+payloadLen))
+	header[4] = id
+	return append(buf, header[:]...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func (KeepAlive) appendTo(buf []byte) []byte {
+	return append(buf, 0, 0, 0, 0)
+}
+
+func (Choke) appendTo(buf []byte) []byte {
+	return appendHeader(buf, IDChoke, 0)
+}
+
+func (Unchoke) appendTo(buf []byte) []byte {
+	return appendHeader(buf, IDUnchoke, 0)
+}
+
+func (Interested) appendTo(buf []byte) []byte {
+	return appendHeader(buf, IDInterested, 0)
+}
+
+func (NotInterested) appendTo(buf []byte) []byte {
+	return appendHeader(buf, IDNotInterested, 0)
+}
+
+func (m Have) appendTo(buf []byte) []byte {
+	buf = appendHeader(buf, IDHave, 4)
+	return appendUint32(buf, m.Index)
+}
+
+func (m Bitfield) appendTo(buf []byte) []byte {
+	buf = appendHeader(buf, IDBitfield, len(m.Bits))
+	return append(buf, m.Bits...)
+}
+
+// Request and cancel payloads:
+// - 4-byte piece index
+// - 4-byte block offset within the piece (in bytes)
+// - 4-byte block length
+func (m Request) appendTo(buf []byte) []byte {
+	buf = appendHeader(buf, IDRequest, 12)
+	buf = appendUint32(buf, m.Index)
+	buf = appendUint32(buf, m.Begin)
+	return appendUint32(buf, m.Length)
+}
+
+// Piece payload:
+// - 4-byte piece index
+// - 4-byte block offset within the piece (in bytes)
+// - data
+func (m Piece) appendTo(buf []byte) []byte {
+	buf = appendHeader(buf, IDPiece, 8+len(m.Block))
+	buf = appendUint32(buf, m.Index)
+	buf = appendUint32(buf, m.Begin)
+	return append(buf, m.Block...)
+}
+
+func (m Cancel) appendTo(buf []byte) []byte {
+	buf = appendHeader(buf, IDCancel, 12)
+	buf = appendUint32(buf, m.Index)
+	buf = appendUint32(buf, m.Begin)
+	return appendUint32(buf, m.Length)
+}
+
+func (m Port) appendTo(buf []byte) []byte {
+	buf = appendHeader(buf, IDPort, 2)
+	return append(buf, byte(m.Port>>8), byte(m.Port))
+}
+
+// Extended payload:
+// - 1-byte extended message id
+// - payload of the extension
+func (m Extended) appendTo(buf []byte) []byte {
+	buf = appendHeader(buf, IDExtended, 1+len(m.Payload))
+	buf = append(buf, m.ExtendedID)
+	return append(buf, m.Payload...)
+}
+
+func (m Unknown) appendTo(buf []byte) []byte {
+	buf = appendHeader(buf, m.ID, len(m.Payload))
+	return append(buf, m.Payload...)
+}
+
+// Encode a message with its length prefix.
+func Marshal(msg Message) []byte {
+	return msg.appendTo(nil)
+}
+
+// Decode the body of a message, i.e. the message id and payload without the
+// length prefix. An empty body is a keep-alive message. The payload of the
+// returned message may share memory with body.
+func Unmarshal(body []byte) (Message, error) {
+	if len(body) == 0 {
+		return KeepAlive{}, nil
+	}
+
+	id := body[0]
+	payload := body[1:]
+	switch id {
+	case IDChoke, IDUnchoke, IDInterested, IDNotInterested:
+		if len(payload) != 0 {
+			return nil, fmt.Errorf("%w: message %v with %v bytes of payload", ErrMalformed, id, len(payload))
+		}
+		switch id {
+		case IDChoke:
+			return Choke{}, nil
+		case IDUnchoke:
+			return Unchoke{}, nil
+		case IDInterested:
+			return Interested{}, nil
+		default:
+			return NotInterested{}, nil
+		}
+	case IDHave:
+		if len(payload) != 4 {
+			return nil, fmt.Errorf("%w: have message with %v bytes of payload", ErrMalformed, len(payload))
+		}
+		return Have{Index: binary.BigEndian.Uint32(payload)}, nil
+	case IDBitfield:
+		return Bitfield{Bits: payload}, nil
+	case IDRequest, IDCancel:
+		if len(payload) != 12 {
+			return nil, fmt.Errorf("%w: message %v with %v bytes of payload", ErrMalformed, id, len(payload))
+		}
+		index := binary.BigEndian.Uint32(payload[0:4])
+		begin := binary.BigEndian.Uint32(payload[4:8])
+		length := binary.BigEndian.Uint32(payload[8:12])
+		if id == IDRequest {
+			return Request{Index: index, Begin: begin, Length: length}, nil
+		}
+		return Cancel{Index: index, Begin: begin, Length: length}, nil
+	case IDPiece:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("%w: piece message with %v bytes of payload", ErrMalformed, len(payload))
+		}
+		return Piece{
+			Index: binary.BigEndian.Uint32(payload[0:4]),
+			Begin: binary.BigEndian.Uint32(payload[4:8]),
+			Block: payload[8:],
+		}, nil
+	case IDPort:
+		if len(payload) != 2 {
+			return nil, fmt.Errorf("%w: port message with %v bytes of payload", ErrMalformed, len(payload))
+		}
+		return Port{Port: binary.BigEndian.Uint16(payload)}, nil
+	case IDExtended:
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("%w: empty extended message", ErrMalformed)
+		}
+		return Extended{ExtendedID: payload[0], Payload: payload[1:]}, nil
+	default:
+		return Unknown{ID: id, Payload: payload}, nil
+	}
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent"
+)
+
+func writeRandomFile(t *testing.T, path string, length int) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(int64(length))).Read(data)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	data := writeRandomFile(t, path, 100000)
+
+	created, encoded, err := torrent.Create(context.Background(), path, &torrent.CreateOptions{
+		Trackers:    [][]string{{"http://tracker/announce"}},
+		PieceLength: 16384,
+		HashWorkers: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := torrent.Parse(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.InfoHash, created.InfoHash) {
+		t.Fatalf("Info hash mismatch: %x, %x", parsed.InfoHash, created.InfoHash)
+	}
+	if parsed.Info.Name != "data.bin" || parsed.Info.Length != len(data) || parsed.Info.IsMultiFile() {
+		t.Fatalf("Unexpected info: %v, %v", parsed.Info.Name, parsed.Info.Length)
+	}
+	if parsed.TrackerURL != "http://tracker/announce" {
+		t.Fatalf("Unexpected tracker: %v", parsed.TrackerURL)
+	}
+
+	if parsed.NumPieces() != 7 {
+		t.Fatalf("Expected 7 pieces, got %v", parsed.NumPieces())
+	}
+	for piece, pieceHash := range parsed.Info.Pieces {
+		end := (piece + 1) * 16384
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[piece*16384 : end])
+		if string(h[:]) != pieceHash {
+			t.Fatalf("Hash mismatch for piece %v", piece)
+		}
+	}
+}
+
+func TestCreateDirectory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "dist")
+	a := writeRandomFile(t, filepath.Join(root, "a.txt"), 5000)
+	b := writeRandomFile(t, filepath.Join(root, "sub", "b.bin"), 40000)
+	writeRandomFile(t, filepath.Join(root, "sub", "empty"), 0)
+
+	created, encoded, err := torrent.Create(context.Background(), root, &torrent.CreateOptions{
+		Trackers:     [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}},
+		Comment:      "build 42",
+		CreatedBy:    "test",
+		CreationDate: time.Unix(1700000000, 0),
+		Private:      true,
+		Source:       "CI",
+		WebSeeds:     []string{"http://mirror/dist/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := torrent.Parse(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.InfoHash, created.InfoHash) {
+		t.Fatalf("Info hash mismatch: %x, %x", parsed.InfoHash, created.InfoHash)
+	}
+	expectedFiles := []torrent.FileEntry{
+		{Length: 5000, Path: []string{"a.txt"}},
+		{Length: 40000, Path: []string{"sub", "b.bin"}},
+		{Length: 0, Path: []string{"sub", "empty"}},
+	}
+	if parsed.Info.Name != "dist" || !reflect.DeepEqual(parsed.Info.Files, expectedFiles) || !parsed.Info.Private {
+		t.Fatalf("Unexpected files: %v %+v", parsed.Info.Name, parsed.Info.Files)
+	}
+
+	// Pieces span files
+	h := sha1.Sum(append(append([]byte{}, a...), b...)[:parsed.Info.PieceLength])
+	if parsed.Info.Pieces[0] != string(h[:]) {
+		t.Fatal("Hash mismatch for piece 0")
+	}
+
+	var metainfo struct {
+		Announce     string     `bencode:"announce"`
+		AnnounceList [][]string `bencode:"announce-list"`
+		Comment      string     `bencode:"comment"`
+		CreatedBy    string     `bencode:"created by"`
+		CreationDate int64      `bencode:"creation date"`
+		URLList      []string   `bencode:"url-list"`
+		Info         struct {
+			Private bool   `bencode:"private"`
+			Source  string `bencode:"source"`
+		} `bencode:"info"`
+	}
+	err = decode.Config{Strict: true}.Unmarshal(encoded, &metainfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metainfo.Announce != "http://a/announce" || len(metainfo.AnnounceList) != 2 ||
+		metainfo.Comment != "build 42" || metainfo.CreatedBy != "test" || metainfo.CreationDate != 1700000000 ||
+		!reflect.DeepEqual(metainfo.URLList, []string{"http://mirror/dist/"}) ||
+		!metainfo.Info.Private || metainfo.Info.Source != "CI" {
+		t.Fatalf("Unexpected metainfo: %+v", metainfo)
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	writeRandomFile(t, path, 100000)
+
+	for _, pieceLength := range []int{1000, 16384 + 1, 8192} {
+		_, _, err := torrent.Create(context.Background(), path, &torrent.CreateOptions{PieceLength: pieceLength})
+		if err == nil {
+			t.Fatalf("Expected an error for piece length %v", pieceLength)
+		}
+	}
+
+	_, _, err := torrent.Create(context.Background(), t.TempDir(), &torrent.CreateOptions{})
+	if err == nil {
+		t.Fatal("Expected an error for an empty directory")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = torrent.Create(ctx, path, &torrent.CreateOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
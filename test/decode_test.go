@@ -1,7 +1,10 @@
 package tests
 
 import (
+	"errors"
+	"io"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/decode"
@@ -25,3 +28,199 @@ func TestDecode(t *testing.T) {
 	testDecodeHelper(t, "l5:helloi52el1:s2:ssi32eee", [](interface{}){"hello", 52, [](interface{}){"s", "ss", 32}})
 	testDecodeHelper(t, "d3:foo3:bar5:helloi52ee", map[string](interface{}){"foo": "bar", "hello": 52})
 }
+
+func TestDecodeDictWithSpans(t *testing.T) {
+	str := "d8:announce3:url4:infod6:lengthi5e7:privatei1eee"
+	_, spans, err := decode.DecodeDictWithSpans(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"announce": "3:url",
+		"info":     "d6:lengthi5e7:privatei1ee",
+	}
+	for key, raw := range expected {
+		span := spans[key]
+		if str[span.Start:span.End] != raw {
+			t.Fatalf("Mismatch for %v! Expected: %v, result: %v", key, raw, str[span.Start:span.End])
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, str := range []string{"", "5:abc", "i12", "l5:hello", "d3:foo", "d3:fooi1e"} {
+		_, err := decode.Decode(str)
+		if err == nil {
+			t.Fatalf("Expected an error for %q", str)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	dec := decode.NewDecoder(strings.NewReader("i52e5:hellod3:fooli1ei2eee4:tail"))
+
+	var n int
+	var s string
+	var dict map[string][]int
+	for _, v := range []interface{}{&n, &s, &dict} {
+		err := dec.Decode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != 52 || s != "hello" || !reflect.DeepEqual(dict, map[string][]int{"foo": {1, 2}}) {
+		t.Fatalf("Unexpected values: %v %v %v", n, s, dict)
+	}
+
+	rest, _ := io.ReadAll(dec.Buffered())
+	if string(rest) != "4:tail" {
+		t.Fatalf("Expected buffered data 4:tail, got %q", rest)
+	}
+	if err := dec.Decode(&s); err != nil || s != "tail" {
+		t.Fatalf("Unexpected value %q, error %v", s, err)
+	}
+	if err := dec.Decode(&s); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+
+	for _, str := range []string{"l5:hello", "5:abc", "i12", "d3:foo"} {
+		var v interface{}
+		err := decode.NewDecoder(strings.NewReader(str)).Decode(&v)
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("Expected unexpected EOF for %q, got %v", str, err)
+		}
+	}
+}
+
+// Values are decoded as they arrive, without waiting for the end of the stream
+func TestDecoderPipe(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+	go func() {
+		w.Write([]byte("d1:ai1ee"))
+		w.Write([]byte("d1:ai2ee"))
+	}()
+
+	dec := decode.NewDecoder(r)
+	for i := 1; i <= 2; i++ {
+		var v struct {
+			A int `bencode:"a"`
+		}
+		err := dec.Decode(&v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.A != i {
+			t.Fatalf("Expected %v, got %v", i, v.A)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	// Rejected in any mode
+	for _, str := range []string{"5abc", "3:", "i-e", "ie", "i1-2e", "i1x", "di1ei2ee", "l1:ae5:extra", "x", "99999999999999999999:a"} {
+		_, err := decode.Decode(str)
+		var syntaxErr *decode.SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Fatalf("Expected a syntax error for %q, got %v", str, err)
+		}
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	strict := decode.Config{Strict: true}
+	for _, str := range []string{"i-0e", "i03e", "i-03e", "03:abc", "d1:bi1e1:ai2ee", "d1:ai1e1:ai2ee"} {
+		_, err := decode.Decode(str)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q in non-strict mode: %v", str, err)
+		}
+		_, err = strict.Decode(str)
+		if err == nil {
+			t.Fatalf("Expected an error for %q in strict mode", str)
+		}
+	}
+
+	for _, str := range []string{"i0e", "i-10e", "0:", "d1:ai1e1:bi2ee", "d0:i1e1:ai2ee"} {
+		_, err := strict.Decode(str)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %v", str, err)
+		}
+	}
+
+	var v map[string]int
+	err := strict.Unmarshal([]byte("d1:ai1e1:ai2ee"), &v)
+	if err == nil {
+		t.Fatal("Expected an error for a duplicate key")
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	_, err := decode.Decode("d3:fooli1ei2x3ee")
+	var syntaxErr *decode.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("Expected a syntax error, got %v", err)
+	}
+	if syntaxErr.Offset != 12 || syntaxErr.Context != "x3ee" {
+		t.Fatalf("Unexpected offset %v, context %q", syntaxErr.Offset, syntaxErr.Context)
+	}
+
+	// Offsets in a stream count from the start of the stream
+	dec := decode.NewDecoder(strings.NewReader("i1e l1:ai2xe"))
+	var v interface{}
+	dec.Decode(&v)
+	err = dec.Decode(&v)
+	if !errors.As(err, &syntaxErr) || syntaxErr.Offset != 3 {
+		t.Fatalf("Expected a syntax error at offset 3, got %v", err)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	config := decode.Config{MaxDepth: 3, MaxStringLength: 5}
+
+	for _, str := range []string{"lllleeee", "d1:ad1:alleeee", "6:abcdef"} {
+		_, err := config.Decode(str)
+		if err == nil {
+			t.Fatalf("Expected an error for %q", str)
+		}
+
+		var v interface{}
+		err = config.NewDecoder(strings.NewReader(str)).Decode(&v)
+		if err == nil {
+			t.Fatalf("Expected a stream error for %q", str)
+		}
+	}
+
+	_, err := config.Decode("lll5:abcdeeee")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deep nesting fails with the default limits instead of exhausting the stack
+	_, err = decode.Decode(strings.Repeat("l", 100000) + strings.Repeat("e", 100000))
+	if err == nil {
+		t.Fatal("Expected an error for deep nesting")
+	}
+
+	// A huge string length doesn't make the stream decoder allocate it
+	var s string
+	err = decode.NewDecoder(strings.NewReader("60000000:abc")).Decode(&s)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected unexpected EOF, got %v", err)
+	}
+
+	// Strings within the limit can't add up to more than MaxLength
+	config = decode.Config{MaxStringLength: 5, MaxLength: 20}
+	var v interface{}
+	err = config.NewDecoder(strings.NewReader("l5:abcde5:abcdee")).Decode(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, str := range []string{"l5:abcde5:abcde5:abcdee", "l" + strings.Repeat("i1e", 10) + "e"} {
+		var syntaxErr *decode.SyntaxError
+		err = config.NewDecoder(strings.NewReader(str)).Decode(&v)
+		if !errors.As(err, &syntaxErr) {
+			t.Fatalf("Expected a syntax error for %q, got %v", str, err)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/dht"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/tracker"
+)
+
+func newTestNodes(t *testing.T, num int) []*dht.Node {
+	nodes := make([]*dht.Node, 0, num)
+	for i := 0; i < num; i++ {
+		config := dht.Config{Addr: "127.0.0.1:0"}
+		if i > 0 {
+			config.BootstrapNodes = []string{nodes[0].Addr().String()}
+		}
+		node, err := dht.NewNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { node.Close() })
+		nodes = append(nodes, node)
+	}
+
+	for _, node := range nodes[1:] {
+		err := node.Bootstrap(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nodes
+}
+
+func TestDHTAnnounceAndGetPeers(t *testing.T) {
+	nodes := newTestNodes(t, 6)
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+
+	_, err := nodes[1].Announce(context.Background(), infoHash, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := nodes[5].GetPeers(context.Background(), infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := netip.MustParseAddrPort("127.0.0.1:1234")
+	found := false
+	for _, peer := range peers {
+		if peer == expected {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected to find peer %v, result: %v", expected, peers)
+	}
+}
+
+func TestDHTRoutingTablePersistence(t *testing.T) {
+	nodes := newTestNodes(t, 3)
+	stateFile := filepath.Join(t.TempDir(), "dht.state")
+
+	err := nodes[2].Save(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := dht.NewNode(dht.Config{Addr: "127.0.0.1:0", StateFile: stateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if !bytes.Equal(restored.ID(), nodes[2].ID()) {
+		t.Fatalf("Expected id %x, result: %x", nodes[2].ID(), restored.ID())
+	}
+	if restored.NumNodes() == 0 {
+		t.Fatal("Expected nodes in the restored routing table")
+	}
+	err = restored.Bootstrap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDHTBootstrapCancelled(t *testing.T) {
+	// A bootstrap node that never responds
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	node, err := dht.NewNode(dht.Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapNodes: []string{silent.LocalAddr().String()},
+		QueryTimeout:   time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = node.Bootstrap(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Bootstrap took %v after the context expired", time.Since(start))
+	}
+}
+
+func TestDHTInvalidStateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "dht.state")
+	err := os.WriteFile(stateFile, []byte("d2:id3:abce"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := dht.NewNode(dht.Config{Addr: "127.0.0.1:0", StateFile: stateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Close()
+
+	// The invalid file is kept aside and replaced by a valid one
+	invalid, err := os.ReadFile(stateFile + ".invalid")
+	if err != nil || string(invalid) != "d2:id3:abce" {
+		t.Fatalf("Expected the invalid state file to be kept, got %q, %v", invalid, err)
+	}
+	restored, err := dht.NewNode(dht.Config{Addr: "127.0.0.1:0", StateFile: stateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if !bytes.Equal(restored.ID(), node.ID()) {
+		t.Fatal("Expected the new state file to be loaded")
+	}
+}
+
+func TestClientDHTRetriesAfterCancel(t *testing.T) {
+	nodes := newTestNodes(t, 3)
+	infoHash := bytes.Repeat([]byte{0xcd}, 20)
+	_, err := nodes[1].Announce(context.Background(), infoHash, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A bootstrap node that never responds keeps the bootstrap going until
+	// its query times out
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	client := torrent.NewClient()
+	client.Port = 0
+	client.DHTBootstrapNodes = []string{nodes[0].Addr().String(), silent.LocalAddr().String()}
+	defer client.Close()
+	magnet, err := torrent.ParseMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.DiscoverPeers(ctx, magnet.Torrent())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	peers, err := client.DiscoverPeers(context.Background(), magnet.Torrent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != netip.MustParseAddrPort("127.0.0.1:1234") {
+		t.Fatalf("Unexpected peers: %v", peers)
+	}
+}
+
+func TestDHTIgnoresSpoofedResponses(t *testing.T) {
+	node, err := dht.NewNode(dht.Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	queried, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queried.Close()
+	spoofer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+
+	res := make(chan error, 1)
+	go func() {
+		res <- node.Ping(context.Background(), netip.MustParseAddrPort(queried.LocalAddr().String()))
+	}()
+
+	buf := make([]byte, 1500)
+	size, _, err := queried.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decode.Decode(string(buf[:size]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid := decoded.(map[string]interface{})["t"].(string)
+
+	// An error response from another address is dropped
+	nodeAddr, _ := net.ResolveUDPAddr("udp", node.Addr().String())
+	spoofed, _ := encode.Encode(map[string]interface{}{"t": tid, "y": "e", "e": []interface{}{201, "spoofed"}})
+	spoofer.WriteTo([]byte(spoofed), nodeAddr)
+	time.Sleep(100 * time.Millisecond)
+
+	response, _ := encode.Encode(map[string]interface{}{
+		"t": tid,
+		"y": "r",
+		"r": map[string]interface{}{"id": string(bytes.Repeat([]byte{1}, 20))},
+	})
+	queried.WriteTo([]byte(response), nodeAddr)
+	err = <-res
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrivateTorrentSkipsDHT(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	client := torrent.NewClient()
+	client.Port = 0
+	client.DHTBootstrapNodes = []string{silent.LocalAddr().String()}
+	defer client.Close()
+
+	path := filepath.Join(t.TempDir(), "data.bin")
+	writeRandomFile(t, path, 1000)
+	trackerURL := newTestTracker(t, "d14:failure reason7:go awaye")
+	tor, _, err := torrent.Create(context.Background(), path, &torrent.CreateOptions{
+		Trackers: [][]string{{trackerURL}},
+		Private:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.DiscoverPeers(context.Background(), tor)
+	if !errors.Is(err, tracker.ErrFailure) {
+		t.Fatalf("Expected the tracker failure, got %v", err)
+	}
+	silent.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = silent.ReadFrom(make([]byte, 1500))
+	if err == nil {
+		t.Fatal("Expected no DHT query for a private torrent")
+	}
+}
@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/encode"
@@ -24,3 +25,26 @@ func TestEncode(t *testing.T) {
 	testEncodeHelper(t, [](interface{}){"hello", 52, [](interface{}){"s", "ss", 32}}, "l5:helloi52el1:s2:ssi32eee")
 	testEncodeHelper(t, map[string](interface{}){"foo": "bar", "hello": 52}, "d3:foo3:bar5:helloi52ee")
 }
+
+func TestEncoder(t *testing.T) {
+	var sb strings.Builder
+	enc := encode.NewEncoder(&sb)
+
+	for _, v := range []interface{}{52, "hello", map[string][]int{"foo": {1, 2}}} {
+		err := enc.Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A value that can't be encoded leaves nothing behind
+	err := enc.Encode([]interface{}{1, 2.5})
+	if err == nil {
+		t.Fatal("Expected an error for a float")
+	}
+
+	expected := "i52e5:hellod3:fooli1ei2eee"
+	if sb.String() != expected {
+		t.Fatalf("Expected: %v, result: %v", expected, sb.String())
+	}
+}
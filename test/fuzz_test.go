@@ -0,0 +1,161 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent"
+)
+
+// Seed inputs: a torrent file, responses of HTTP trackers and DHT messages,
+// and malformed values the decoder once mishandled
+func addSeeds(f *testing.F) {
+	data, err := os.ReadFile("../sample.torrent")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+
+	for _, seed := range []string{
+		// compact announce response
+		"d8:completei3e10:incompletei1e8:intervali60e12:min intervali60e5:peers18:\xa5\xe8\x21\x4d\xc9\x0b\xb2\x3e\x52\x59\xc9\x0b\xb2\x3e\x55\x14\xc9\x0be",
+		// noncompact announce response
+		"d8:intervali1800e5:peersld2:ip13:192.168.1.1007:peer id20:-TR2940-abcdefghijkl4:porti51413eeee",
+		"d8:intervali60e5:peers6:\x01\x02\x03\x04\x1a\xe16:peers618:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2e",
+		"d14:failure reason17:torrent not founde",
+		// scrape response
+		"d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei5e10:downloadedi50e10:incompletei10eeee",
+		// DHT query and response
+		"d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+		"d1:rd2:id20:mnopqrstuvwxyz1234565:nodes26:abcdefghij0123456789\x7f\x00\x00\x01\x1a\xe1e1:t2:aa1:y1:re",
+		// extension handshake
+		"d1:md11:ut_metadatai3e6:ut_pexi2ee13:metadata_sizei31235e1:pi6881e4:reqqi250e1:v5:mybte",
+		"5abc", "i-0e", "i03e", "di1ei2ee", "l", "d3:foo", "99999999999999999999:a",
+	} {
+		f.Add([]byte(seed))
+	}
+}
+
+// Decoding never panics, and a decoded value encodes to input that decodes
+// to the same value. In strict mode only the canonical encoding is accepted,
+// so the input is reproduced exactly.
+func FuzzDecode(f *testing.F) {
+	addSeeds(f)
+	strict := decode.Config{Strict: true}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, err := decode.Decode(string(data))
+		if err != nil {
+			return
+		}
+
+		encoded, err := encode.Encode(decoded)
+		if err != nil {
+			t.Fatalf("Can't encode decoded value %v: %v", decoded, err)
+		}
+		redecoded, err := decode.Decode(encoded)
+		if err != nil {
+			t.Fatalf("Can't decode %q: %v", encoded, err)
+		}
+		if !reflect.DeepEqual(decoded, redecoded) {
+			t.Fatalf("Mismatch! Expected: %v, result: %v", decoded, redecoded)
+		}
+
+		_, err = strict.Decode(string(data))
+		if err == nil && encoded != string(data) {
+			t.Fatalf("Strict decoding accepted non-canonical %q, canonical %q", data, encoded)
+		}
+	})
+}
+
+// The stream decoder agrees with Decode on single values.
+func FuzzDecoder(f *testing.F) {
+	addSeeds(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, err := decode.Decode(string(data))
+
+		var streamed, extra interface{}
+		dec := decode.NewDecoder(bytes.NewReader(data))
+		streamErr := dec.Decode(&streamed)
+		if streamErr == nil && dec.Decode(&extra) != io.EOF {
+			// Data after the value makes Decode fail, but not the stream
+			streamErr = errors.New("data after value")
+		}
+
+		if (err == nil) != (streamErr == nil) {
+			t.Fatalf("Decode error %v, stream error %v for %q", err, streamErr, data)
+		}
+		if err == nil && !reflect.DeepEqual(decoded, streamed) {
+			t.Fatalf("Mismatch! Decode: %v, stream: %v", decoded, streamed)
+		}
+	})
+}
+
+type fuzzInfo struct {
+	Files []struct {
+		Length int64    `bencode:"length"`
+		Path   []string `bencode:"path"`
+	} `bencode:"files,omitempty"`
+	Length      *int64 `bencode:"length"`
+	Name        string `bencode:"name"`
+	PieceLength uint32 `bencode:"piece length"`
+	Pieces      []byte `bencode:"pieces"`
+	Private     bool   `bencode:"private,omitempty"`
+}
+
+type fuzzMetainfo struct {
+	Announce     string                 `bencode:"announce"`
+	AnnounceList [][]string             `bencode:"announce-list,omitempty"`
+	Info         *fuzzInfo              `bencode:"info"`
+	Extra        map[string]interface{} `bencode:"extra,omitempty"`
+}
+
+// Unmarshal never panics, and a struct it fills marshals to a value that
+// unmarshals and marshals back to the same bytes. Comparing encodings rather
+// than structs ignores the difference between nil and empty slices and maps.
+func FuzzUnmarshal(f *testing.F) {
+	addSeeds(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var metainfo fuzzMetainfo
+		err := decode.Unmarshal(data, &metainfo)
+		if err != nil {
+			return
+		}
+
+		encoded, err := encode.Marshal(metainfo)
+		if err != nil {
+			t.Fatalf("Can't marshal %+v: %v", metainfo, err)
+		}
+		var remarshalled fuzzMetainfo
+		err = decode.Unmarshal(encoded, &remarshalled)
+		if err != nil {
+			t.Fatalf("Can't unmarshal %q: %v", encoded, err)
+		}
+		reencoded, err := encode.Marshal(remarshalled)
+		if err != nil {
+			t.Fatalf("Can't marshal %+v: %v", remarshalled, err)
+		}
+		if !bytes.Equal(encoded, reencoded) {
+			t.Fatalf("Mismatch! Expected: %q, result: %q", encoded, reencoded)
+		}
+	})
+}
+
+// Parsing a torrent file never panics.
+func FuzzParseTorrent(f *testing.F) {
+	addSeeds(f)
+	f.Add([]byte("d8:announce3:url4:infod5:filesld6:lengthi5e4:pathl1:aeee4:name1:x12:piece lengthi5e6:pieces20:" + strings.Repeat("a", 20) + "ee"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		torrent.Parse(data)
+	})
+}
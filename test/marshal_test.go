@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+)
+
+type testFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testInfo struct {
+	Name        string     `bencode:"name"`
+	PieceLength uint32     `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+	Private     bool       `bencode:"private,omitempty"`
+	Files       []testFile `bencode:"files,omitempty"`
+	Length      *int       `bencode:"length"`
+	Ignored     string     `bencode:"-"`
+}
+
+type testMetainfo struct {
+	Announce string            `bencode:"announce"`
+	Comment  string            `bencode:"comment,omitempty"`
+	Info     decode.RawMessage `bencode:"info"`
+	Extra    map[string]int    `bencode:"extra,omitempty"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	str := "d8:announce3:url5:extrad1:ai1e1:bi2ee4:infod5:filesld6:lengthi5e4:pathl1:a1:beee4:name4:test12:piece lengthi16384e6:pieces3:abc7:privatei1ee7:unknownl1:xee"
+
+	var metainfo testMetainfo
+	err := decode.Unmarshal([]byte(str), &metainfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metainfo.Announce != "url" || !reflect.DeepEqual(metainfo.Extra, map[string]int{"a": 1, "b": 2}) {
+		t.Fatalf("Unexpected metainfo: %+v", metainfo)
+	}
+
+	rawInfo := "d5:filesld6:lengthi5e4:pathl1:a1:beee4:name4:test12:piece lengthi16384e6:pieces3:abc7:privatei1ee"
+	if string(metainfo.Info) != rawInfo {
+		t.Fatalf("Expected raw info: %v, result: %v", rawInfo, string(metainfo.Info))
+	}
+
+	var info testInfo
+	err = decode.Unmarshal(metainfo.Info, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := testInfo{
+		Name:        "test",
+		PieceLength: 16384,
+		Pieces:      []byte("abc"),
+		Private:     true,
+		Files:       []testFile{{Length: 5, Path: []string{"a", "b"}}},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("Mismatch! Expected: %+v, result: %+v", expected, info)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var info testInfo
+	err := decode.Unmarshal([]byte("d4:namei5ee"), &info)
+	var typeErr *decode.UnmarshalTypeError
+	if !errors.As(err, &typeErr) || typeErr.Value != "integer" || typeErr.Offset != 7 {
+		t.Fatalf("Expected a type error, got %v", err)
+	}
+
+	var small struct {
+		N int8 `bencode:"n"`
+	}
+	for _, str := range []string{"d1:ni300ee", "d1:ni1e", "d1:n"} {
+		if decode.Unmarshal([]byte(str), &small) == nil {
+			t.Fatalf("Expected an error for %q", str)
+		}
+	}
+
+	if decode.Unmarshal([]byte("i1e"), small) == nil {
+		t.Fatal("Expected an error for a non-pointer")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	length := 5
+	info := testInfo{
+		Name:        "test",
+		PieceLength: 16384,
+		Pieces:      []byte("abc"),
+		Length:      &length,
+		Ignored:     "x",
+	}
+
+	encoded, err := encode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "d6:lengthi5e4:name4:test12:piece lengthi16384e6:pieces3:abce"
+	if string(encoded) != expected {
+		t.Fatalf("Expected: %v, result: %v", expected, string(encoded))
+	}
+
+	metainfo := testMetainfo{Announce: "url", Info: encoded}
+	encoded, err = encode.Marshal(&metainfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "d8:announce3:url4:info" + expected + "e"
+	if string(encoded) != expected {
+		t.Fatalf("Expected: %v, result: %v", expected, string(encoded))
+	}
+
+	// Round trip
+	var decoded testMetainfo
+	err = decode.Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, metainfo) {
+		t.Fatalf("Mismatch! Expected: %+v, result: %+v", metainfo, decoded)
+	}
+
+	_, err = encode.Marshal(map[int]string{1: "a"})
+	if err == nil {
+		t.Fatal("Expected an error for a map with int keys")
+	}
+}
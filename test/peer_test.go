@@ -0,0 +1,241 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peertest"
+	"github.com/codecrafters-io/bittorrent-starter-go/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+func TestPeerPieceBounds(t *testing.T) {
+	pc, _ := peertest.Connect(t, 10)
+
+	valid := []peerwire.Message{
+		peerwire.Have{Index: 9},
+		peerwire.Bitfield{Bits: []byte{0x80, 0x40}},
+	}
+	for _, msg := range valid {
+		err := pc.HandleStateMsg(msg)
+		if err != nil {
+			t.Fatalf("%#v: %v", msg, err)
+		}
+	}
+	if !pc.HasPiece(0) || !pc.HasPiece(9) || pc.HasPiece(1) || len(pc.Bitfield) != 2 {
+		t.Fatalf("Unexpected bitfield: %x", pc.Bitfield)
+	}
+
+	invalid := []peerwire.Message{
+		peerwire.Have{Index: 10},
+		peerwire.Have{Index: 0xffffffff},
+		peerwire.Bitfield{Bits: []byte{0x80}},
+		peerwire.Bitfield{Bits: make([]byte, 1024*1024)},
+		// spare bit set
+		peerwire.Bitfield{Bits: []byte{0x80, 0x20}},
+	}
+	for _, msg := range invalid {
+		err := pc.HandleStateMsg(msg)
+		if !errors.Is(err, peer.ErrUnexpectedMessage) {
+			t.Fatalf("%T: expected ErrUnexpectedMessage, got %v", msg, err)
+		}
+	}
+	if len(pc.Bitfield) != 2 {
+		t.Fatalf("Bitfield grew to %v bytes", len(pc.Bitfield))
+	}
+}
+
+// Extension handler recording the handshake and the messages it gets
+type recordingExtension struct {
+	name      string
+	handshake *peer.ExtHandshake
+	messages  [][]byte
+}
+
+func (ext *recordingExtension) Name() string {
+	return ext.name
+}
+
+func (ext *recordingExtension) OnHandshake(hs *peer.ExtHandshake) error {
+	ext.handshake = hs
+	return nil
+}
+
+func (ext *recordingExtension) OnMessage(payload []byte) error {
+	ext.messages = append(ext.messages, payload)
+	return nil
+}
+
+// Feed an extension handshake with the given fields to the connection.
+func receiveExtHandshake(t *testing.T, pc *peer.Conn, dict map[string]interface{}) error {
+	encoded, err := encode.Encode(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc.HandleStateMsg(peerwire.Extended{ExtendedID: 0, Payload: []byte(encoded)})
+}
+
+func TestExtensionNegotiation(t *testing.T) {
+	pc, remote := peertest.Connect(t, 0)
+	if !pc.SupportsExtensions || !remote.SupportsExtensions {
+		t.Fatal("Expected both sides to support extensions")
+	}
+
+	ext := &recordingExtension{name: "ut_test"}
+	pc.RegisterExtension(ext)
+	err := pc.SendExtHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := remote.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = remote.HandleStateMsg(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := remote.PeerExtensionID("ut_test"); id != 1 {
+		t.Fatalf("Expected ut_test to have id 1, got %v", id)
+	}
+
+	// A peer without the reserved bit doesn't get an extension handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	infoHash := make([]byte, 20)
+	reserved := make(chan [8]byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		hs, err := peerwire.ReadHandshake(conn)
+		if err != nil {
+			return
+		}
+		reserved <- hs.Reserved
+		response := peerwire.Handshake{}
+		copy(response.InfoHash[:], infoHash)
+		conn.Write(response.Marshal())
+		conn.Read(make([]byte, 1))
+	}()
+
+	addr := netip.MustParseAddrPort(listener.Addr().String())
+	plain, err := peer.Dial(context.Background(), addr, infoHash, 0, peer.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if ours := <-reserved; ours[peer.ExtensionReservedByte]&peer.ExtensionReservedBit == 0 {
+		t.Fatalf("Expected our handshake to set the extension bit, got %x", ours)
+	}
+	if plain.SupportsExtensions {
+		t.Fatal("Expected the peer not to support extensions")
+	}
+	if plain.SendExtHandshake() == nil {
+		t.Fatal("Expected an error sending the extension handshake")
+	}
+}
+
+func TestExtHandshakeParsing(t *testing.T) {
+	pc, _ := peertest.Connect(t, 0)
+	ext := &recordingExtension{name: "ut_test"}
+	pc.RegisterExtension(ext)
+
+	err := receiveExtHandshake(t, pc, map[string]interface{}{
+		"m": map[string]interface{}{
+			"ut_metadata": 3,
+			"ut_pex":      1,
+			"disabled":    0,
+			"negative":    -1,
+			"too_big":     256,
+			"not_an_int":  "2",
+		},
+		"v":             "Test 1.0",
+		"p":             6881,
+		"reqq":          100,
+		"metadata_size": 12345,
+		"yourip":        "\x7f\x00\x00\x01",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &peer.ExtHandshake{
+		M:            map[string]int{"ut_metadata": 3, "ut_pex": 1},
+		V:            "Test 1.0",
+		P:            6881,
+		Reqq:         100,
+		MetadataSize: 12345,
+		YourIP:       []byte{127, 0, 0, 1},
+	}
+	if !reflect.DeepEqual(ext.handshake, expected) {
+		t.Fatalf("Mismatch! Expected: %+v, result: %+v", expected, ext.handshake)
+	}
+	for name, id := range map[string]int{"ut_pex": 1, "disabled": 0, "negative": 0, "too_big": 0, "unknown": 0} {
+		if pc.PeerExtensionID(name) != id {
+			t.Fatalf("Expected %v to have id %v, got %v", name, id, pc.PeerExtensionID(name))
+		}
+	}
+
+	yourips := map[string][]byte{
+		"\x7f\x00\x00\x01":       {127, 0, 0, 1},
+		string(net.IPv6loopback): net.IPv6loopback,
+		"\x7f\x00\x00":           nil,
+		"\x7f\x00\x00\x01\x00":   nil,
+		"":                       nil,
+	}
+	for yourip, expected := range yourips {
+		err = receiveExtHandshake(t, pc, map[string]interface{}{"yourip": yourip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ext.handshake.YourIP, expected) {
+			t.Fatalf("yourip %x: expected %v, got %v", yourip, expected, ext.handshake.YourIP)
+		}
+	}
+
+	for _, payload := range []string{"i42e", "d1:m", "l1:me"} {
+		err = pc.HandleStateMsg(peerwire.Extended{ExtendedID: 0, Payload: []byte(payload)})
+		if err == nil {
+			t.Fatalf("%q: expected an error", payload)
+		}
+	}
+}
+
+func TestExtendedMessageDispatch(t *testing.T) {
+	pc, _ := peertest.Connect(t, 0)
+	first := &recordingExtension{name: "ut_first"}
+	second := &recordingExtension{name: "ut_second"}
+	pc.RegisterExtension(first)
+	pc.RegisterExtension(second)
+
+	// Messages use the ids we advertised, in the order of registration
+	msgs := []peerwire.Extended{
+		{ExtendedID: 2, Payload: []byte("to second")},
+		{ExtendedID: 1, Payload: []byte("to first")},
+		{ExtendedID: 3, Payload: []byte("unknown")},
+		{ExtendedID: 255, Payload: []byte("unknown")},
+	}
+	for _, msg := range msgs {
+		err := pc.HandleStateMsg(msg)
+		if err != nil {
+			t.Fatalf("Extended id %v: %v", msg.ExtendedID, err)
+		}
+	}
+	if !reflect.DeepEqual(first.messages, [][]byte{[]byte("to first")}) ||
+		!reflect.DeepEqual(second.messages, [][]byte{[]byte("to second")}) {
+		t.Fatalf("Unexpected messages: %q, %q", first.messages, second.messages)
+	}
+}
@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/peerwire"
+)
+
+func TestPeerwireRoundTrip(t *testing.T) {
+	messages := []peerwire.Message{
+		peerwire.KeepAlive{},
+		peerwire.Choke{},
+		peerwire.Unchoke{},
+		peerwire.Interested{},
+		peerwire.NotInterested{},
+		peerwire.Have{Index: 7},
+		peerwire.Bitfield{Bits: []byte{0xf0, 0x01}},
+		peerwire.Request{Index: 1, Begin: 16384, Length: 16384},
+		peerwire.Piece{Index: 1, Begin: 16384, Block: []byte("block")},
+		peerwire.Cancel{Index: 1, Begin: 16384, Length: 16384},
+		peerwire.Port{Port: 6881},
+		peerwire.Extended{ExtendedID: 1, Payload: []byte("d1:mdee")},
+		peerwire.Unknown{ID: 42, Payload: []byte{1, 2}},
+	}
+
+	var buf bytes.Buffer
+	w := peerwire.NewWriter(&buf)
+	for _, msg := range messages {
+		err := w.WriteMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := peerwire.NewReader(&buf)
+	for _, expected := range messages {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, msg) {
+			t.Fatalf("Mismatch! Expected: %#v, result: %#v", expected, msg)
+		}
+	}
+	_, err := r.ReadMessage()
+	if err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+// Fails every other read, delivering at most one byte per successful read.
+type flakyReader struct {
+	data []byte
+	fail bool
+}
+
+var errFlaky = errors.New("flaky read")
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	r.fail = !r.fail
+	if r.fail {
+		return 0, errFlaky
+	}
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestPeerwireResumesAfterFailedRead(t *testing.T) {
+	expected := peerwire.Piece{Index: 3, Begin: 0, Block: []byte("some data")}
+	data := append(peerwire.Marshal(expected), peerwire.Marshal(peerwire.Have{Index: 2})...)
+	r := peerwire.NewReader(&flakyReader{data: data})
+
+	results := make([]peerwire.Message, 0)
+	for len(results) < 2 {
+		msg, err := r.ReadMessage()
+		if errors.Is(err, errFlaky) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, msg)
+	}
+
+	if !reflect.DeepEqual(results, []peerwire.Message{expected, peerwire.Have{Index: 2}}) {
+		t.Fatalf("Mismatch! Result: %#v", results)
+	}
+}
+
+func TestPeerwireRejectsInvalidMessages(t *testing.T) {
+	r := peerwire.NewReader(bytes.NewReader([]byte{0, 0, 0, 3, peerwire.IDHave, 0, 1}))
+	_, err := r.ReadMessage()
+	if !errors.Is(err, peerwire.ErrMalformed) {
+		t.Fatalf("Expected ErrMalformed, got %v", err)
+	}
+
+	r = peerwire.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	_, err = r.ReadMessage()
+	if !errors.Is(err, peerwire.ErrTooLong) {
+		t.Fatalf("Expected ErrTooLong, got %v", err)
+	}
+}
+
+func TestPeerwireHandshake(t *testing.T) {
+	h := peerwire.Handshake{}
+	h.Reserved[5] = 0x10
+	copy(h.InfoHash[:], "aaaaaaaaaaaaaaaaaaaa")
+	copy(h.PeerID[:], "bbbbbbbbbbbbbbbbbbbb")
+
+	encoded := h.Marshal()
+	if len(encoded) != peerwire.HandshakeLength {
+		t.Fatalf("Expected %v bytes, got %v", peerwire.HandshakeLength, len(encoded))
+	}
+	decoded, err := peerwire.ReadHandshake(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != h {
+		t.Fatalf("Mismatch! Expected: %v, result: %v", h, *decoded)
+	}
+
+	encoded[1] = 'b'
+	_, err = peerwire.ReadHandshake(bytes.NewReader(encoded))
+	if !errors.Is(err, peerwire.ErrInvalidHandshake) {
+		t.Fatalf("Expected ErrInvalidHandshake, got %v", err)
+	}
+}
+
+func TestPeerwireDispatch(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(peerwire.Marshal(peerwire.Have{Index: 1}))
+	buf.Write(peerwire.Marshal(peerwire.KeepAlive{}))
+	buf.Write(peerwire.Marshal(peerwire.Unchoke{}))
+
+	results := make([]peerwire.Message, 0)
+	err := peerwire.Dispatch(peerwire.NewReader(&buf), func(msg peerwire.Message) error {
+		results = append(results, msg)
+		return nil
+	})
+	if err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+	expected := []peerwire.Message{peerwire.Have{Index: 1}, peerwire.KeepAlive{}, peerwire.Unchoke{}}
+	if !reflect.DeepEqual(expected, results) {
+		t.Fatalf("Mismatch! Expected: %v, result: %v", expected, results)
+	}
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+)
+
+// Number of random values checked by each property
+const propertyRuns = 2000
+
+// A random value as produced by decode.Decode: int, string, []interface{} or
+// map[string]interface{}, nested at most depth levels.
+func randomValue(r *rand.Rand, depth int) interface{} {
+	kind := r.Intn(4)
+	if depth == 0 {
+		kind = r.Intn(2)
+	}
+
+	switch kind {
+	case 0:
+		// Small integers are more likely to hit edge cases such as 0 and -1
+		if r.Intn(2) == 0 {
+			return r.Intn(21) - 10
+		}
+		return int(r.Uint64())
+	case 1:
+		return randomString(r)
+	case 2:
+		list := make([]interface{}, r.Intn(5))
+		for i := range list {
+			list[i] = randomValue(r, depth-1)
+		}
+		return list
+	default:
+		dict := make(map[string]interface{})
+		for i := r.Intn(5); i > 0; i-- {
+			dict[randomString(r)] = randomValue(r, depth-1)
+		}
+		return dict
+	}
+}
+
+// A string of random bytes, often of characters that mean something in
+// bencode
+func randomString(r *rand.Rand) string {
+	b := make([]byte, r.Intn(12))
+	for i := range b {
+		if r.Intn(2) == 0 {
+			b[i] = "0123456789:ilde-"[r.Intn(16)]
+		} else {
+			b[i] = byte(r.Intn(256))
+		}
+	}
+	return string(b)
+}
+
+func checkProperty(t *testing.T, property func(r *rand.Rand, v interface{}, encoded string)) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < propertyRuns; i++ {
+		v := randomValue(r, 4)
+		encoded, err := encode.Encode(v)
+		if err != nil {
+			t.Fatalf("Can't encode %v: %v", v, err)
+		}
+		property(r, v, encoded)
+	}
+}
+
+// Decoding an encoded value gives the value back
+func TestPropertyRoundTrip(t *testing.T) {
+	checkProperty(t, func(r *rand.Rand, v interface{}, encoded string) {
+		decoded, err := decode.Decode(encoded)
+		if err != nil {
+			t.Fatalf("Can't decode %q: %v", encoded, err)
+		}
+		if !reflect.DeepEqual(decoded, v) {
+			t.Fatalf("Mismatch! Expected: %v, result: %v", v, decoded)
+		}
+	})
+}
+
+// The encoder only produces canonical encodings, which strict decoding
+// accepts, and decoding them again gives the same bytes
+func TestPropertyCanonical(t *testing.T) {
+	strict := decode.Config{Strict: true}
+	checkProperty(t, func(r *rand.Rand, v interface{}, encoded string) {
+		decoded, err := strict.Decode(encoded)
+		if err != nil {
+			t.Fatalf("Strict decoding rejected %q: %v", encoded, err)
+		}
+		reencoded, _ := encode.Encode(decoded)
+		if reencoded != encoded {
+			t.Fatalf("Mismatch! Expected: %q, result: %q", encoded, reencoded)
+		}
+	})
+}
+
+// No proper prefix of an encoded value is a valid value, and DecodePrefix
+// finds the end of a value followed by other data
+func TestPropertyPrefix(t *testing.T) {
+	checkProperty(t, func(r *rand.Rand, v interface{}, encoded string) {
+		n := r.Intn(len(encoded))
+		_, err := decode.Decode(encoded[:n])
+		if err == nil {
+			t.Fatalf("Decoded truncated %q", encoded[:n])
+		}
+
+		decoded, length, err := decode.DecodePrefix(encoded + randomString(r))
+		if err != nil || length != len(encoded) || !reflect.DeepEqual(decoded, v) {
+			t.Fatalf("DecodePrefix of %q: %v, %v, %v", encoded, decoded, length, err)
+		}
+	})
+}
+
+// Values written one after another with an Encoder are read back by a
+// Decoder
+func TestPropertyStream(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	values := make([]interface{}, propertyRuns)
+	var buf bytes.Buffer
+	enc := encode.NewEncoder(&buf)
+	for i := range values {
+		values[i] = randomValue(r, 4)
+		err := enc.Encode(values[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Read in small chunks, so values span reads
+	dec := decode.NewDecoder(&oneByteReader{&buf})
+	for _, v := range values {
+		var decoded interface{}
+		err := dec.Decode(&decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, v) {
+			t.Fatalf("Mismatch! Expected: %v, result: %v", v, decoded)
+		}
+	}
+
+	var extra interface{}
+	if err := dec.Decode(&extra); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent"
+)
+
+func TestResumeMultiFile(t *testing.T) {
+	src := t.TempDir()
+	writeRandomFile(t, filepath.Join(src, "dist", "a.txt"), 5000)
+	writeRandomFile(t, filepath.Join(src, "dist", "sub", "b.bin"), 40000)
+	// A private torrent whose tracker gives no peers, so a download that needs
+	// a piece fails without going to the DHT
+	tracker := newTestTracker(t, "d8:intervali60e5:peers0:e")
+	multi, _, err := torrent.Create(context.Background(), filepath.Join(src, "dist"), &torrent.CreateOptions{
+		Trackers:    [][]string{{tracker}},
+		PieceLength: 16384,
+		Private:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := torrent.NewClient()
+	writeState := func(path string, bitfield string) {
+		state, err := encode.Encode(map[string]interface{}{
+			"bitfield":  bitfield,
+			"info hash": string(multi.InfoHash),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(state), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertMissing := func(path string) {
+		_, err := os.Stat(path)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Expected %v not to exist, got %v", path, err)
+		}
+	}
+
+	// Without a state file, the existing files are scanned
+	out := t.TempDir()
+	writeRandomFile(t, filepath.Join(out, "dist", "a.txt"), 5000)
+	writeRandomFile(t, filepath.Join(out, "dist", "sub", "b.bin"), 40000)
+	err = client.Download(context.Background(), multi, out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMissing(filepath.Join(out, "dist.state"))
+
+	// Corrupted files are scanned as well, and the missing pieces downloaded
+	out = t.TempDir()
+	writeRandomFile(t, filepath.Join(out, "dist", "a.txt"), 5000)
+	writeRandomFile(t, filepath.Join(out, "dist", "sub", "b.bin"), 40001)
+	err = client.Download(context.Background(), multi, out, nil)
+	if err == nil {
+		t.Fatal("Expected the download to need peers")
+	}
+
+	// The state file is kept next to the torrent's directory, not next to the
+	// output directory, and is trusted without scanning: the last piece is
+	// downloaded again although the files hold it
+	out = t.TempDir()
+	writeRandomFile(t, filepath.Join(out, "dist", "a.txt"), 5000)
+	writeRandomFile(t, filepath.Join(out, "dist", "sub", "b.bin"), 40000)
+	writeState(filepath.Join(out, "dist.state"), "\xc0")
+	err = client.Download(context.Background(), multi, out, nil)
+	if err == nil {
+		t.Fatal("Expected the download to need peers")
+	}
+	assertMissing(out + ".state")
+
+	// A state file claiming pieces that aren't on disk is discarded, and the
+	// files are scanned: an empty directory or truncated files don't make a
+	// complete download
+	out = t.TempDir()
+	err = os.MkdirAll(filepath.Join(out, "dist"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeState(filepath.Join(out, "dist.state"), "\xe0")
+	err = client.Download(context.Background(), multi, out, nil)
+	if err == nil {
+		t.Fatal("Expected the download to need peers")
+	}
+	out = t.TempDir()
+	writeRandomFile(t, filepath.Join(out, "dist", "a.txt"), 5000)
+	writeRandomFile(t, filepath.Join(out, "dist", "sub", "b.bin"), 40000)
+	err = os.Truncate(filepath.Join(out, "dist", "sub", "b.bin"), 20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeState(filepath.Join(out, "dist.state"), "\xe0")
+	err = client.Download(context.Background(), multi, out, nil)
+	if err == nil {
+		t.Fatal("Expected the download to need peers")
+	}
+
+	// A state file without the torrent's directory is stale
+	out = t.TempDir()
+	writeState(filepath.Join(out, "dist.state"), "\xe0")
+	err = client.Download(context.Background(), multi, out, nil)
+	if err == nil {
+		t.Fatal("Expected the download to need peers")
+	}
+	assertMissing(filepath.Join(out, "dist.state"))
+}
@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent"
+)
+
+func TestSeedErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	writeRandomFile(t, path, 100000)
+	single, _, err := torrent.Create(context.Background(), path, &torrent.CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRandomFile(t, filepath.Join(dir, "dist", "a.txt"), 5000)
+	multi, _, err := torrent.Create(context.Background(), filepath.Join(dir, "dist"), &torrent.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := torrent.NewClient()
+	client.Port = 0
+
+	// Wrong paths fail without creating any file
+	empty := t.TempDir()
+	missing := filepath.Join(empty, "data.bin")
+	err = client.Seed(context.Background(), single, missing, 1)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist, got %v", err)
+	}
+	err = client.Seed(context.Background(), multi, empty, 1)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist, got %v", err)
+	}
+	entries, _ := os.ReadDir(empty)
+	if len(entries) != 0 {
+		t.Fatalf("Seeding created %v files", len(entries))
+	}
+
+	// A state file claiming every piece isn't trusted
+	writeRandomFile(t, path, 99999)
+	state, err := encode.Encode(map[string]interface{}{
+		"bitfield":  "\xff\xc0",
+		"info hash": string(single.InfoHash),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path+".state", []byte(state), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Seed(context.Background(), single, path, 1)
+	if err == nil {
+		t.Fatal("Expected an error for data failing the hash check")
+	}
+}
@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/tracker"
+)
+
+// A port that was free a moment ago, for a seeder to listen on.
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// A peer claiming every piece of the torrent and answering every request with
+// random data. Returns its address and the number of blocks it sent.
+func startCorruptPeer(t *testing.T, tor *torrent.Torrent) (netip.AddrPort, *int64) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var numBlocks int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				pc, err := peer.Accept(conn, tor.InfoHash, tor.NumPieces(), peer.Config{})
+				if err != nil {
+					conn.Close()
+					return
+				}
+				defer pc.Close()
+
+				bits := peer.NewBitfield(tor.NumPieces())
+				for piece := 0; piece < tor.NumPieces(); piece++ {
+					bits.Set(piece)
+				}
+				pc.Send(peerwire.Bitfield{Bits: bits})
+				pc.Send(peerwire.Unchoke{})
+				for {
+					msg, err := pc.ReadMessage()
+					if err != nil {
+						return
+					}
+					if req, ok := msg.(peerwire.Request); ok {
+						block := make([]byte, req.Length)
+						rand.Read(block)
+						pc.Send(peerwire.Piece{Index: req.Index, Begin: req.Begin, Block: block})
+						atomic.AddInt64(&numBlocks, 1)
+					}
+				}
+			}()
+		}
+	}()
+
+	return netip.MustParseAddrPort(listener.Addr().String()), &numBlocks
+}
+
+func TestSwarmWithCorruptPeer(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	data := writeRandomFile(t, path, 40*16384+1000)
+	tor, _, err := torrent.Create(context.Background(), path, &torrent.CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The corrupt peer comes first, so it's given pieces before the download
+	// can finish
+	corruptAddr, corruptBlocks := startCorruptPeer(t, tor)
+	seederPort := freePort(t)
+	seederAddr := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(seederPort))
+	response, err := encode.Encode(map[string]interface{}{
+		"interval": 60,
+		"peers":    string(tracker.EncodeCompactPeers([]netip.AddrPort{corruptAddr, seederAddr}, 4)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor.TrackerTiers = [][]string{{newTestTracker(t, response)}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	seeder := torrent.NewClient()
+	seeder.Port = seederPort
+	seedErr := make(chan error, 1)
+	go func() {
+		seedErr <- seeder.Seed(ctx, tor, path, 4)
+	}()
+	waitListening(t, seederAddr, seedErr)
+
+	output := filepath.Join(t.TempDir(), "data.bin")
+	downloadCtx, downloadCancel := context.WithTimeout(ctx, 30*time.Second)
+	defer downloadCancel()
+	err = torrent.NewClient().Download(downloadCtx, tor, output, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downloaded, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Fatal("Downloaded data doesn't match")
+	}
+	if atomic.LoadInt64(corruptBlocks) == 0 {
+		t.Fatal("Expected the corrupt peer to be asked for pieces")
+	}
+
+	cancel()
+	if err := <-seedErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the seeder to stop, got %v", err)
+	}
+}
+
+// Wait until the seeder accepts connections, or fails.
+func waitListening(t *testing.T, addr netip.AddrPort, seedErr chan error) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", addr.String())
+		if err == nil {
+			conn.Close()
+			return
+		}
+		select {
+		case err := <-seedErr:
+			t.Fatalf("Seeding failed: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatal("Seeder isn't listening")
+}
@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/tracker"
+)
+
+func TestParseTorrent(t *testing.T) {
+	data, err := os.ReadFile("../sample.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor, err := torrent.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tor.TrackerURL != "http://bittorrent-test-tracker.codecrafters.io/announce" {
+		t.Fatalf("Unexpected tracker URL: %v", tor.TrackerURL)
+	}
+	if hex.EncodeToString(tor.InfoHash) != "d69f91e6b2ae4c542468d1073a71d4ea13879a7f" {
+		t.Fatalf("Unexpected info hash: %x", tor.InfoHash)
+	}
+	if tor.Info.Length != 92063 || tor.Info.PieceLength != 32768 {
+		t.Fatalf("Unexpected length %v, piece length %v", tor.Info.Length, tor.Info.PieceLength)
+	}
+	if tor.NumPieces() != 3 || tor.PieceSize(2) != 92063-2*32768 {
+		t.Fatalf("Unexpected pieces: %v, last %v", tor.NumPieces(), tor.PieceSize(2))
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	link := "magnet:?xt=urn:btih:d69f91e6b2ae4c542468d1073a71d4ea13879a7f&dn=sample.torrent&tr=http%3A%2F%2Fbittorrent-test-tracker.codecrafters.io%2Fannounce"
+	magnet, err := torrent.ParseMagnet(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hex.EncodeToString(magnet.InfoHash) != "d69f91e6b2ae4c542468d1073a71d4ea13879a7f" {
+		t.Fatalf("Unexpected info hash: %x", magnet.InfoHash)
+	}
+	if magnet.DisplayName != "sample.torrent" {
+		t.Fatalf("Unexpected name: %v", magnet.DisplayName)
+	}
+
+	tor := magnet.Torrent()
+	expected := [][]string{{"http://bittorrent-test-tracker.codecrafters.io/announce"}}
+	if !reflect.DeepEqual(tor.TrackerTiers, expected) {
+		t.Fatalf("Unexpected tiers: %v", tor.TrackerTiers)
+	}
+
+	_, err = torrent.ParseMagnet("http://example.com")
+	if err == nil {
+		t.Fatal("Expected an error for a non-magnet link")
+	}
+}
+
+func TestCompactPeers(t *testing.T) {
+	peers := []netip.AddrPort{
+		netip.MustParseAddrPort("1.2.3.4:6881"),
+		netip.MustParseAddrPort("10.0.0.1:51413"),
+	}
+
+	encoded := tracker.EncodeCompactPeers(peers, 4)
+	if len(encoded) != 12 {
+		t.Fatalf("Unexpected length: %v", len(encoded))
+	}
+
+	// Trailing bytes are ignored
+	decoded := tracker.ParseCompactPeers(append(encoded, 0xff), 4)
+	if !reflect.DeepEqual(decoded, peers) {
+		t.Fatalf("Mismatch! Expected: %v, result: %v", peers, decoded)
+	}
+}
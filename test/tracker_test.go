@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/tracker"
+)
+
+func newTestTracker(t *testing.T, response string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/announce"
+}
+
+func TestAnnounceHTTP(t *testing.T) {
+	req := &tracker.AnnounceRequest{InfoHash: make([]byte, 20), Port: 6881}
+	expected := []netip.AddrPort{
+		netip.MustParseAddrPort("1.2.3.4:6881"),
+		netip.MustParseAddrPort("[::1]:6882"),
+	}
+
+	responses := []string{
+		// compact, with IPv6 peers in peers6
+		"d8:intervali60e5:peers6:\x01\x02\x03\x04\x1a\xe16:peers618:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2e",
+		// noncompact
+		"d8:intervali60e5:peersld2:ip7:1.2.3.44:porti6881eed2:ip3:::14:porti6882eeee",
+	}
+	for _, response := range responses {
+		peers, err := tracker.Announce(context.Background(), newTestTracker(t, response), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(peers, expected) {
+			t.Fatalf("Mismatch! Expected: %v, result: %v", expected, peers)
+		}
+	}
+
+	_, err := tracker.Announce(context.Background(), newTestTracker(t, "d14:failure reason7:go awaye"), req)
+	var trackerErr *tracker.Error
+	if !errors.Is(err, tracker.ErrFailure) || !errors.As(err, &trackerErr) || trackerErr.Reason != "go away" {
+		t.Fatalf("Expected a tracker failure, got %v", err)
+	}
+
+	_, err = tracker.Announce(context.Background(), newTestTracker(t, "d5:peersi5ee"), req)
+	if err == nil {
+		t.Fatal("Expected an error for invalid peers")
+	}
+
+	// A hostile tracker can't make us buffer an endless response
+	block := "1000000:" + strings.Repeat("x", 1000000)
+	huge := "d5:peersl" + strings.Repeat(block, 100) + "ee"
+	_, err = tracker.Announce(context.Background(), newTestTracker(t, huge), req)
+	var syntaxErr *decode.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("Expected a syntax error for a huge response, got %v", err)
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	infoHash := "aaaaaaaaaaaaaaaaaaaa"
+	url := newTestTracker(t, "d5:filesd20:"+infoHash+"d8:completei3e10:downloadedi10e10:incompletei2eeee")
+
+	results, err := tracker.Scrape(context.Background(), url, [][]byte{[]byte(infoHash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := tracker.ScrapeResult{Seeders: 3, Completed: 10, Leechers: 2}
+	if results[infoHash] != expected {
+		t.Fatalf("Mismatch! Expected: %+v, result: %+v", expected, results[infoHash])
+	}
+}
@@ -0,0 +1,208 @@
+package torrent
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+// The choker re-evaluates which peers are unchoked this often
+const ChokeInterval = 10 * time.Second
+
+// The optimistic unchoke moves to another peer every this many choke rounds,
+// i.e. every 30 seconds
+const OptimisticUnchokeRounds = 3
+
+// A peer that hasn't sent us a block for this long is snubbed: it only gets
+// unchoked optimistically until it sends data again
+const SnubTimeout = time.Minute
+
+// Number of peers we upload to at the same time, including the optimistic
+// unchoke
+const DefaultUploadSlots = 4
+
+// Tit-for-tat choker. Every ChokeInterval, the interested peers with the best
+// rate are unchoked: the rate at which they send us data while downloading, or
+// the rate at which they take data from us while seeding. One more peer is
+// unchoked optimistically, regardless of its rate, so that new peers get a
+// chance to prove themselves.
+type choker struct {
+	slots   int
+	seeding bool
+
+	mu         sync.Mutex
+	peers      map[*peer.Conn]*chokerPeer
+	optimistic *peer.Conn
+	round      int
+}
+
+// Transfer totals of a peer at the last round, used to compute its rates.
+type chokerPeer struct {
+	addedAt        time.Time
+	lastUploaded   int64
+	lastDownloaded int64
+	uploadRate     float64 // bytes per second during the last round
+	downloadRate   float64
+}
+
+func newChoker(slots int, seeding bool) *choker {
+	if slots < 1 {
+		slots = 1
+	}
+	return &choker{
+		slots:   slots,
+		seeding: seeding,
+		peers:   make(map[*peer.Conn]*chokerPeer),
+	}
+}
+
+func (c *choker) add(pc *peer.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.peers[pc] = &chokerPeer{addedAt: time.Now()}
+}
+
+func (c *choker) remove(pc *peer.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.peers, pc)
+	if c.optimistic == pc {
+		c.optimistic = nil
+	}
+}
+
+// Called when a peer becomes interested. It's unchoked right away if an upload
+// slot is free, instead of waiting for the next round.
+func (c *choker) peerInterested(pc *peer.Conn) error {
+	c.mu.Lock()
+	numUnchoked := 0
+	for p := range c.peers {
+		if !p.IsChoking() {
+			numUnchoked++
+		}
+	}
+	c.mu.Unlock()
+
+	if numUnchoked >= c.slots {
+		return nil
+	}
+	return pc.SetChoking(false)
+}
+
+// Run choke rounds until ctx is cancelled.
+func (c *choker) run(ctx context.Context) {
+	ticker := time.NewTicker(ChokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.rechoke()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// A single choke round: update the rates, pick the peers to unchoke, and send
+// choke and unchoke messages for the peers whose state changes.
+func (c *choker) rechoke() {
+	c.mu.Lock()
+
+	c.round++
+	candidates := make([]*peer.Conn, 0, len(c.peers))
+	for pc, state := range c.peers {
+		stats := pc.Stats()
+		uploaded, downloaded, lastBlockAt := stats.Uploaded, stats.Downloaded, stats.LastBlockAt
+		interested := pc.IsInterested()
+
+		state.uploadRate = float64(uploaded-state.lastUploaded) / ChokeInterval.Seconds()
+		state.downloadRate = float64(downloaded-state.lastDownloaded) / ChokeInterval.Seconds()
+		state.lastUploaded = uploaded
+		state.lastDownloaded = downloaded
+
+		if !interested {
+			continue
+		}
+		if !c.seeding && isSnubbed(state.addedAt, lastBlockAt) {
+			continue
+		}
+		candidates = append(candidates, pc)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := c.peers[candidates[i]], c.peers[candidates[j]]
+		if c.seeding {
+			return a.uploadRate > b.uploadRate
+		}
+		return a.downloadRate > b.downloadRate
+	})
+
+	// One slot is kept for the optimistic unchoke
+	numRegular := c.slots - 1
+	if numRegular > len(candidates) {
+		numRegular = len(candidates)
+	}
+	unchoke := make(map[*peer.Conn]bool)
+	for _, pc := range candidates[:numRegular] {
+		unchoke[pc] = true
+	}
+
+	if c.optimistic != nil && (!c.optimistic.IsInterested() || unchoke[c.optimistic]) {
+		c.optimistic = nil
+	}
+	if c.optimistic == nil || c.round%OptimisticUnchokeRounds == 0 {
+		c.optimistic = c.pickOptimistic(unchoke)
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+
+	peers := make([]*peer.Conn, 0, len(c.peers))
+	for pc := range c.peers {
+		peers = append(peers, pc)
+	}
+	c.mu.Unlock()
+
+	for _, pc := range peers {
+		err := pc.SetChoking(!unchoke[pc])
+		if err != nil {
+			dprintf("Failed to update choke state of %v: %v\n", pc.Addr, err)
+		}
+	}
+}
+
+// Pick a random interested peer that isn't unchoked already, including
+// snubbed peers. The current optimistic unchoke is only picked again if
+// there's no other choice. Must be called with c.mu held.
+func (c *choker) pickOptimistic(unchoked map[*peer.Conn]bool) *peer.Conn {
+	choices := make([]*peer.Conn, 0)
+	for pc := range c.peers {
+		if !unchoked[pc] && pc != c.optimistic && pc.IsInterested() {
+			choices = append(choices, pc)
+		}
+	}
+	if len(choices) == 0 {
+		if c.optimistic != nil && !unchoked[c.optimistic] && c.optimistic.IsInterested() {
+			return c.optimistic
+		}
+		return nil
+	}
+	return choices[rand.Intn(len(choices))]
+}
+
+// A peer is snubbed if it hasn't sent a block for SnubTimeout since we
+// connected to it.
+func isSnubbed(addedAt time.Time, lastBlockAt time.Time) bool {
+	last := addedAt
+	if lastBlockAt.After(last) {
+		last = lastBlockAt
+	}
+	return time.Since(last) > SnubTimeout
+}
@@ -0,0 +1,91 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peertest"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+func newTestChoker(t *testing.T, slots int, seeding bool, numPeers int) (*choker, []*peer.Conn) {
+	c := newChoker(slots, seeding)
+	peers := make([]*peer.Conn, numPeers)
+	for i := range peers {
+		peers[i], _ = peertest.Connect(t, 0)
+		peers[i].SetInterested(true)
+		c.add(peers[i])
+	}
+	return c, peers
+}
+
+func unchokedPeers(peers []*peer.Conn) map[*peer.Conn]bool {
+	unchoked := make(map[*peer.Conn]bool)
+	for _, pc := range peers {
+		if !pc.IsChoking() {
+			unchoked[pc] = true
+		}
+	}
+	return unchoked
+}
+
+func TestRechokeDownloadRate(t *testing.T) {
+	c, peers := newTestChoker(t, 3, false, 5)
+	fast, medium, slow, snubbed, uninterested := peers[0], peers[1], peers[2], peers[3], peers[4]
+	c.peers[snubbed].addedAt = time.Now().Add(-2 * SnubTimeout)
+	uninterested.SetInterested(false)
+
+	optimistic := make([]*peer.Conn, 0)
+	for round := 1; round <= 2*OptimisticUnchokeRounds; round++ {
+		fast.RecordDownloaded(300 * 1024)
+		medium.RecordDownloaded(200 * 1024)
+		slow.RecordDownloaded(100 * 1024)
+		c.rechoke()
+
+		unchoked := unchokedPeers(peers)
+		if len(unchoked) != 3 || !unchoked[fast] || !unchoked[medium] || unchoked[uninterested] {
+			t.Fatalf("Round %v: unexpected unchoked peers: %v", round, unchoked)
+		}
+		// The slow and the snubbed peer take turns in the optimistic slot
+		if c.optimistic != slow && c.optimistic != snubbed || !unchoked[c.optimistic] {
+			t.Fatalf("Round %v: unexpected optimistic unchoke", round)
+		}
+		optimistic = append(optimistic, c.optimistic)
+	}
+
+	for round := 1; round < len(optimistic); round++ {
+		rotated := optimistic[round] != optimistic[round-1]
+		if rotated != ((round+1)%OptimisticUnchokeRounds == 0) {
+			t.Fatalf("Round %v: optimistic unchoke rotated: %v", round+1, rotated)
+		}
+	}
+}
+
+func TestRechokeSeeding(t *testing.T) {
+	c, peers := newTestChoker(t, 2, true, 3)
+	// Snubbing only applies to downloads
+	for _, pc := range peers {
+		c.peers[pc].addedAt = time.Now().Add(-2 * SnubTimeout)
+	}
+	peers[1].RecordUploaded(100 * 1024)
+	peers[2].RecordDownloaded(500 * 1024)
+	c.rechoke()
+
+	unchoked := unchokedPeers(peers)
+	if len(unchoked) != 2 || !unchoked[peers[1]] || c.optimistic == peers[1] {
+		t.Fatalf("Unexpected unchoked peers: %v", unchoked)
+	}
+
+	// A peer leaving frees its slot for the next interested peer
+	c.remove(c.optimistic)
+	late, _ := peertest.Connect(t, 0)
+	c.add(late)
+	late.SetInterested(true)
+	err := c.peerInterested(late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if late.IsChoking() {
+		t.Fatal("Expected a free slot to be used right away")
+	}
+}
@@ -0,0 +1,135 @@
+// Package torrent is a BitTorrent client library. Parse a torrent file with
+// Parse or a magnet link with ParseMagnet, then use a Client to find peers,
+// download and seed the torrent:
+//
+//	t, err := torrent.Parse(data)
+//	...
+//	client := torrent.NewClient()
+//	defer client.Close()
+//	err = client.Download(ctx, t, "out", nil)
+//
+// Network operations take a context; cancelling it stops them and closes the
+// connections to peers.
+package torrent
+
+import (
+	"context"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/dht"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+// Peer id used by NewClient
+const DefaultPeerID = "deadbeefliveporkhaha"
+
+// Port used by NewClient, on which we accept peer connections while seeding
+// and run the DHT node
+const DefaultPort = 6881
+
+// Well-known nodes to join the DHT from when we have no saved routing table
+var DefaultDHTBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// A Client downloads and seeds torrents. It holds the state shared between
+// torrents: our peer id, the port we listen on, and the DHT node, which is
+// started on first use. Set the fields before the first operation. Methods
+// can be called from multiple goroutines.
+type Client struct {
+	PeerID            [20]byte
+	Port              int
+	DHTBootstrapNodes []string
+	// File the DHT routing table is kept in between runs. Not saved if empty.
+	DHTStateFile string
+
+	dhtMu   sync.Mutex
+	dhtNode *dht.Node
+	dhtErr  error // why the node couldn't be started, not retried
+}
+
+func NewClient() *Client {
+	c := &Client{
+		Port:              DefaultPort,
+		DHTBootstrapNodes: DefaultDHTBootstrapNodes,
+	}
+	copy(c.PeerID[:], DefaultPeerID)
+	return c
+}
+
+// Stop the DHT node if it was started, saving the routing table. Call it once
+// no operation is running.
+func (c *Client) Close() error {
+	c.dhtMu.Lock()
+	defer c.dhtMu.Unlock()
+
+	if c.dhtNode != nil {
+		return c.dhtNode.Close()
+	}
+	return nil
+}
+
+func (c *Client) peerConfig() peer.Config {
+	return peer.Config{PeerID: c.PeerID, Port: c.Port}
+}
+
+// Connect to a peer of the torrent and perform the handshake. The caller
+// should close the connection when finished.
+func (c *Client) Connect(ctx context.Context, torrent *Torrent, addr netip.AddrPort) (*peer.Conn, error) {
+	return peer.Dial(ctx, addr, torrent.InfoHash, torrent.NumPieces(), c.peerConfig())
+}
+
+// Start the DHT node and join the network, if not done already. If ctx is
+// cancelled while joining the network, the node isn't started, and the next
+// call tries again. Other errors are returned by later calls as well.
+func (c *Client) getDHTNode(ctx context.Context) (*dht.Node, error) {
+	c.dhtMu.Lock()
+	defer c.dhtMu.Unlock()
+
+	if c.dhtNode != nil || c.dhtErr != nil {
+		return c.dhtNode, c.dhtErr
+	}
+
+	config := dht.Config{
+		Addr:           ":" + strconv.Itoa(c.Port),
+		BootstrapNodes: c.DHTBootstrapNodes,
+		StateFile:      c.DHTStateFile,
+	}
+
+	node, err := dht.NewNode(config)
+	if err != nil {
+		// The port may be taken by another client
+		config.Addr = ":0"
+		node, err = dht.NewNode(config)
+	}
+	if err != nil {
+		c.dhtErr = err
+		return nil, err
+	}
+
+	err = node.Bootstrap(ctx)
+	if err != nil {
+		node.Close()
+		if ctx.Err() == nil {
+			c.dhtErr = err
+		}
+		return nil, err
+	}
+	if config.StateFile != "" {
+		node.Save(config.StateFile)
+	}
+	c.dhtNode = node
+	return node, nil
+}
+
+func (c *Client) discoverPeersDHT(ctx context.Context, torrent *Torrent) ([]netip.AddrPort, error) {
+	node, err := c.getDHTNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.GetPeers(ctx, torrent.InfoHash)
+}
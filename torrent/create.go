@@ -0,0 +1,309 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+)
+
+// Bounds of the piece length chosen by Create. Piece lengths are powers of
+// two no smaller than a block.
+const MinPieceLength = BlockMaxSize
+const MaxPieceLength = 16 * 1024 * 1024
+
+// Create picks the smallest piece length that keeps the number of pieces, and
+// so the size of the torrent file, below this
+const targetNumPieces = 1500
+
+// Options of Create. PieceLength, Private and Source go into the info dict,
+// so they affect the info hash; the others don't.
+type CreateOptions struct {
+	// Tiers of tracker URLs (BEP 12). The first URL is the announce URL.
+	Trackers [][]string
+	// 0 to choose one from the total length
+	PieceLength int
+	Comment     string
+	CreatedBy   string
+	// Left out if zero
+	CreationDate time.Time
+	// Peers should only be found through the trackers, not DHT or PEX (BEP 27)
+	Private bool
+	// Tag of the site the torrent is published on, which also gives the
+	// torrent a distinct info hash
+	Source string
+	// URLs the data can be downloaded from over HTTP (BEP 19)
+	WebSeeds []string
+	// Number of goroutines hashing pieces, runtime.NumCPU() if 0
+	HashWorkers int
+}
+
+// A torrent file as written by Create. Parse reads only the fields of
+// metainfo, so that torrents with unusual optional fields still parse.
+type createdMetainfo struct {
+	Announce     string            `bencode:"announce,omitempty"`
+	AnnounceList [][]string        `bencode:"announce-list,omitempty"`
+	Comment      string            `bencode:"comment,omitempty"`
+	CreatedBy    string            `bencode:"created by,omitempty"`
+	CreationDate int64             `bencode:"creation date,omitempty"`
+	Info         decode.RawMessage `bencode:"info"`
+	URLList      []string          `bencode:"url-list,omitempty"`
+}
+
+// Create a torrent of the file or directory at path. A directory gives a
+// multi-file torrent of the regular files under it, named after the
+// directory. The pieces are hashed in parallel; cancelling ctx stops hashing.
+//
+// Returns the torrent and the encoded torrent file. The torrent can be seeded
+// right away, from path for a file or from the parent directory of path for a
+// directory.
+func Create(ctx context.Context, path string, opts *CreateOptions) (*Torrent, []byte, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := Info{Name: filepath.Base(path), Private: opts.Private}
+	if !isSafePathComponent(info.Name) {
+		return nil, nil, fmt.Errorf("invalid name: %q", info.Name)
+	}
+	files, err := findFiles(path, &info)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &storage{}
+	defer s.Close()
+	offset := int64(0)
+	for i, filename := range files {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		length := int64(info.Length)
+		if info.IsMultiFile() {
+			length = int64(info.Files[i].Length)
+		}
+		s.files = append(s.files, storageFile{file: file, offset: offset, length: length})
+		offset += length
+	}
+
+	info.PieceLength = opts.PieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = choosePieceLength(info.Length)
+	}
+	if info.PieceLength < MinPieceLength || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, nil, fmt.Errorf("piece length %v is not a power of two of at least %v", info.PieceLength, MinPieceLength)
+	}
+
+	workers := opts.HashWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	info.Pieces, err = hashPieces(ctx, s, int64(info.Length), info.PieceLength, workers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dict := infoDict{
+		Name:        info.Name,
+		PieceLength: info.PieceLength,
+		Pieces:      strings.Join(info.Pieces, ""),
+		Private:     info.Private,
+		Source:      opts.Source,
+	}
+	if info.IsMultiFile() {
+		for _, file := range info.Files {
+			dict.Files = append(dict.Files, fileDict{Length: file.Length, Path: file.Path})
+		}
+	} else {
+		dict.Length = &info.Length
+	}
+	encodedInfo, err := encode.Marshal(dict)
+	if err != nil {
+		return nil, nil, err
+	}
+	info.raw = string(encodedInfo)
+
+	metainfo := createdMetainfo{
+		Comment:   opts.Comment,
+		CreatedBy: opts.CreatedBy,
+		Info:      encodedInfo,
+		URLList:   opts.WebSeeds,
+	}
+	if !opts.CreationDate.IsZero() {
+		metainfo.CreationDate = opts.CreationDate.Unix()
+	}
+	// Empty URLs and tiers are dropped
+	trackers := make([][]string, 0, len(opts.Trackers))
+	for _, tier := range opts.Trackers {
+		urls := make([]string, 0, len(tier))
+		for _, url := range tier {
+			if url != "" {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			trackers = append(trackers, urls)
+		}
+	}
+	if len(trackers) > 0 {
+		metainfo.Announce = trackers[0][0]
+		// announce-list is only needed for more than one tracker
+		if len(trackers) > 1 || len(trackers[0]) > 1 {
+			metainfo.AnnounceList = trackers
+		}
+	}
+	data, err := encode.Marshal(metainfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	infoHash, err := info.hash()
+	if err != nil {
+		return nil, nil, err
+	}
+	torrent := &Torrent{
+		TrackerURL:   metainfo.Announce,
+		TrackerTiers: shuffleTiers(trackers),
+		InfoHash:     infoHash,
+		Info:         info,
+	}
+	return torrent, data, nil
+}
+
+// Find the files to include from path, filling in the length and, for a
+// directory, the files of info. Returns the paths of the files in the order
+// of the torrent data.
+func findFiles(path string, info *Info) ([]string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		info.Length = int(stat.Size())
+		return []string{path}, nil
+	}
+
+	// WalkDir visits files in lexical order, so the order is reproducible
+	files := make([]string, 0)
+	info.Files = make([]FileEntry, 0)
+	err = filepath.WalkDir(path, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			// directories, symlinks, devices, ...
+			return nil
+		}
+
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, filename)
+		if err != nil {
+			return err
+		}
+		components := strings.Split(filepath.ToSlash(rel), "/")
+		for _, component := range components {
+			if !isSafePathComponent(component) {
+				return fmt.Errorf("invalid file path component: %q", component)
+			}
+		}
+
+		files = append(files, filename)
+		info.Files = append(info.Files, FileEntry{Length: int(stat.Size()), Path: components})
+		info.Length += int(stat.Size())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files in %v", path)
+	}
+
+	return files, nil
+}
+
+func choosePieceLength(length int) int {
+	pieceLength := MinPieceLength
+	for pieceLength < MaxPieceLength && length/pieceLength >= targetNumPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// Hash the pieces of the torrent data in s with the given number of
+// goroutines. Each reads whole pieces, which may span files.
+func hashPieces(ctx context.Context, s *storage, length int64, pieceLength int, workers int) ([]string, error) {
+	numPieces := int((length + int64(pieceLength) - 1) / int64(pieceLength))
+	pieces := make([]string, numPieces)
+
+	parentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	next := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for piece := range next {
+				offset := int64(piece) * int64(pieceLength)
+				data := buf
+				if offset+int64(pieceLength) > length {
+					data = buf[:length-offset]
+				}
+
+				_, err := s.ReadAt(data, offset)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						// e.g. a file was truncated while we hashed it
+						firstErr = fmt.Errorf("reading piece %v: %w", piece, err)
+					}
+					mu.Unlock()
+					cancel()
+					continue
+				}
+
+				h := sha1.Sum(data)
+				pieces[piece] = string(h[:])
+			}
+		}()
+	}
+
+feed:
+	for piece := 0; piece < numPieces; piece++ {
+		select {
+		case next <- piece:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if parentCtx.Err() != nil {
+		return nil, parentCtx.Err()
+	}
+	dprintf("Hashed %v pieces with %v workers\n", numPieces, workers)
+	return pieces, nil
+}
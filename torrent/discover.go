@@ -0,0 +1,77 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/tracker"
+)
+
+// Ask the trackers of the torrent for peers. If the trackers give no peers,
+// the DHT is used instead, unless the torrent is private.
+func (c *Client) DiscoverPeers(ctx context.Context, torrent *Torrent) ([]netip.AddrPort, error) {
+	peers, err := c.announce(ctx, torrent)
+	if err == nil && len(peers) > 0 {
+		return peers, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if torrent.Info.Private {
+		return peers, err
+	}
+
+	dprintf("No peers from trackers (%v), trying DHT\n", err)
+	dhtPeers, dhtErr := c.discoverPeersDHT(ctx, torrent)
+	if dhtErr != nil {
+		if err != nil {
+			return nil, fmt.Errorf("%v; %w", err, dhtErr)
+		}
+		return nil, dhtErr
+	}
+	return dhtPeers, nil
+}
+
+// Announce to the trackers of the torrent, returning the peers they give. The
+// tiers are reordered on a copy, so the lock isn't held while announcing, and
+// the order found is kept for the next announce.
+func (c *Client) announce(ctx context.Context, torrent *Torrent) ([]netip.AddrPort, error) {
+	tiers := torrent.copyTrackerTiers()
+	peers, err := tracker.AnnounceTiers(ctx, tiers, &tracker.AnnounceRequest{
+		InfoHash: torrent.InfoHash,
+		PeerID:   c.PeerID,
+		Port:     c.Port,
+		Left:     torrent.bytesLeft(),
+	})
+
+	torrent.trackersMu.Lock()
+	torrent.TrackerTiers = tiers
+	torrent.trackersMu.Unlock()
+	return peers, err
+}
+
+func (torrent *Torrent) copyTrackerTiers() [][]string {
+	torrent.trackersMu.Lock()
+	defer torrent.trackersMu.Unlock()
+
+	tiers := make([][]string, 0, len(torrent.TrackerTiers))
+	for _, tier := range torrent.TrackerTiers {
+		tiers = append(tiers, append([]string(nil), tier...))
+	}
+	return tiers
+}
+
+// Number of bytes left to download, as reported to trackers. The length of a
+// torrent created from a magnet link may be unknown until the metadata is
+// fetched, in which case a non-zero value is reported so that trackers treat us
+// as a leecher. A seeder reports 0.
+func (torrent *Torrent) bytesLeft() int {
+	if torrent.complete {
+		return 0
+	}
+	if torrent.Info.Length == 0 {
+		return 1
+	}
+	return torrent.Info.Length
+}
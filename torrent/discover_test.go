@@ -0,0 +1,46 @@
+package torrent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestAnnounceConcurrently(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason7:go awaye"))
+	}))
+	defer failing.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali60e5:peers6:\x01\x02\x03\x04\x1a\xe1e"))
+	}))
+	defer working.Close()
+
+	torrent := &Torrent{
+		TrackerTiers: [][]string{{failing.URL, working.URL}},
+		InfoHash:     make([]byte, 20),
+	}
+	c := NewClient()
+
+	// A download and a seed of the same torrent announce at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peers, err := c.announce(context.Background(), torrent)
+			if err != nil || len(peers) != 1 {
+				t.Errorf("Expected a peer, got %v, %v", peers, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	expected := [][]string{{working.URL, failing.URL}}
+	if !reflect.DeepEqual(torrent.TrackerTiers, expected) {
+		t.Fatalf("Mismatch! Expected: %v, result: %v", expected, torrent.TrackerTiers)
+	}
+}
@@ -0,0 +1,542 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+// Maximum number of peers we download from at the same time
+const MaxPeerConns = 10
+
+// A peer that doesn't send a block of the piece it's downloading within this
+// time is dropped
+const PieceTimeout = 30 * time.Second
+
+// A peer that sends this many pieces failing the hash check is banned
+const MaxHashFailures = 3
+
+// When a peer has no piece we can pick right now, we wait this long for it to
+// announce new pieces, or for other peers to give up pieces, before retrying
+const PickRetryInterval = 2 * time.Second
+
+var errChoked = errors.New("choked by peer")
+
+// Returned when another peer completed the piece first in endgame mode
+var errPieceDone = errors.New("piece completed by another peer")
+
+type pieceWork struct {
+	index  int
+	length int
+}
+
+// Request for the i-th block of the piece. Blocks are BlockMaxSize bytes, except
+// for the last one which may be shorter.
+func (work pieceWork) blockRequest(i int) peerwire.Request {
+	blockOffset := i * BlockMaxSize
+	blockSize := BlockMaxSize
+	if blockOffset+blockSize > work.length {
+		blockSize = work.length - blockOffset
+	}
+	return peerwire.Request{Index: uint32(work.index), Begin: uint32(blockOffset), Length: uint32(blockSize)}
+}
+
+type pieceResult struct {
+	index int
+	data  []byte
+	peer  netip.AddrPort
+}
+
+// State of a full-file download shared between the peer workers.
+type download struct {
+	client   *Client
+	torrent  *Torrent
+	picker   *piecePicker
+	results  chan pieceResult
+	exited   chan netip.AddrPort // peer workers report here when they stop
+	done     <-chan struct{}     // closed when the download finishes or is cancelled
+	pool     *peerPool
+	uploader *uploader // serves the pieces we have to peers interested in them
+
+	mu           sync.Mutex
+	hashFailures map[netip.AddrPort]int           // number of corrupted pieces sent by each peer
+	connected    map[netip.AddrPort]connectedPeer // peers we're downloading from
+}
+
+type connectedPeer struct {
+	pc  *peer.Conn
+	pex *utPex // nil if the peer doesn't support extensions or the torrent is private
+}
+
+// Download the whole file from multiple peers concurrently. Each peer is given
+// the rarest piece it has by the piece picker. When a peer disconnects, chokes
+// us or times out, the piece it was working on goes back to the picker for
+// another peer to pick up, and the peer is retried later. Peers come from the
+// trackers and from peer exchange, which is disabled for private torrents.
+//
+// Meanwhile, the pieces we have are uploaded to the peers, with
+// DefaultUploadSlots peers unchoked by the choker at a time, favouring the
+// peers we download from fastest.
+//
+// priorities overrides the priority of some pieces, which may be nil.
+//
+// For a multi-file torrent, outputFilename is the directory in which the
+// directory named after the torrent is created.
+//
+// If the output file already exists, the download resumes: pieces already in
+// the file are kept and only the missing ones are requested.
+//
+// Cancelling ctx disconnects all peers and returns the context's error. The
+// state file is written after every piece, so the download can be resumed.
+func (c *Client) Download(ctx context.Context, torrent *Torrent, outputFilename string, priorities map[int]int) error {
+	infoHash := torrent.InfoHash
+
+	stateFile := torrent.stateFilename(outputFilename)
+	_, err := os.Stat(torrent.dataPath(outputFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		// A state file without the output file is stale
+		err = removeStateFile(stateFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	output, err := torrent.openStorage(outputFilename, false)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	progress := torrent.loadProgress(stateFile, output, infoHash)
+	numDone := progress.Count(torrent.NumPieces())
+	if numDone == torrent.NumPieces() {
+		return removeStateFile(stateFile)
+	}
+
+	peers, err := c.DiscoverPeers(ctx, torrent)
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		return fmt.Errorf("no peers found")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d := download{
+		client:  c,
+		torrent: torrent,
+		picker:  newPiecePicker(torrent.NumPieces(), progress),
+		results: make(chan pieceResult),
+		exited:  make(chan netip.AddrPort),
+		done:    ctx.Done(),
+		pool:    newPeerPool(),
+
+		hashFailures: make(map[netip.AddrPort]int),
+		connected:    make(map[netip.AddrPort]connectedPeer),
+	}
+	d.uploader = &uploader{
+		torrent: torrent,
+		storage: output,
+		has:     d.picker.isDone,
+		choker:  newChoker(DefaultUploadSlots, false),
+	}
+	d.pool.add(peers)
+	if !torrent.Info.Private {
+		go d.runPex()
+	}
+	go d.uploader.choker.run(ctx)
+
+	for piece, priority := range priorities {
+		d.picker.setPriority(piece, priority)
+	}
+
+	numWorkers := 0
+	startPeers := func() {
+		for numWorkers < MaxPeerConns {
+			peer, ok := d.pool.next()
+			if !ok {
+				return
+			}
+			if d.isBanned(peer) {
+				continue
+			}
+			go d.runPeer(ctx, peer)
+			numWorkers++
+		}
+	}
+	startPeers()
+
+	for numDone < torrent.NumPieces() {
+		select {
+		case res := <-d.results:
+			if progress.Has(res.index) {
+				// downloaded twice in endgame mode
+				continue
+			}
+			offset := int64(res.index) * int64(torrent.Info.PieceLength)
+			_, err := output.WriteAt(res.data, offset)
+			if err != nil {
+				return err
+			}
+			d.picker.finished(res.index)
+			d.pool.resetRetries(res.peer)
+			numDone++
+			dprintf("Piece %v done (%v/%v)\n", res.index, numDone, torrent.NumPieces())
+			go d.sendHave(res.index)
+
+			progress.Set(res.index)
+			err = writeStateFile(stateFile, infoHash, progress)
+			if err != nil {
+				return err
+			}
+		case peer := <-d.exited:
+			dprintf("Peer %v exited\n", peer)
+			numWorkers--
+			if !d.isBanned(peer) {
+				d.pool.retry(peer)
+			}
+			startPeers()
+			if numWorkers == 0 && !d.pool.hasPeers() {
+				return fmt.Errorf("all peers disconnected, %v pieces remaining", torrent.NumPieces()-numDone)
+			}
+		case <-d.pool.added:
+			startPeers()
+		case <-ctx.Done():
+			dprintf("Download stopped, %v/%v pieces done\n", numDone, torrent.NumPieces())
+			return ctx.Err()
+		}
+	}
+
+	return removeStateFile(stateFile)
+}
+
+// Download pieces from a single peer until the download finishes or the peer
+// becomes unusable.
+func (d *download) runPeer(ctx context.Context, addr netip.AddrPort) {
+	defer func() {
+		select {
+		case d.exited <- addr:
+		case <-d.done:
+		}
+	}()
+
+	pc, err := d.client.Connect(ctx, d.torrent, addr)
+	if err != nil {
+		dprintf("Failed to connect to %v: %v\n", addr, err)
+		return
+	}
+	defer pc.Close()
+
+	// Unblock any pending read once the download is over
+	stop := peer.CloseOnCancel(ctx, pc)
+	defer stop()
+
+	pc.OnHave = d.picker.peerHas
+	defer func() {
+		d.picker.removePeer(pc.Bitfield)
+	}()
+
+	have := d.picker.doneBitfield()
+	if have.Count(d.torrent.NumPieces()) > 0 {
+		err = pc.Send(peerwire.Bitfield{Bits: have})
+		if err != nil {
+			return
+		}
+	}
+	removeUploadPeer := d.uploader.addPeer(pc)
+	defer removeUploadPeer()
+
+	var pex *utPex
+	if pc.SupportsExtensions {
+		if !d.torrent.Info.Private {
+			pex = &utPex{pc: pc, onPeers: d.pool.add}
+			pc.RegisterExtension(pex)
+		}
+		err = pc.SendExtHandshake()
+		if err != nil {
+			return
+		}
+	}
+	d.setConnected(addr, connectedPeer{pc: pc, pex: pex})
+	defer d.setDisconnected(addr)
+
+	err = pc.Send(peerwire.Interested{})
+	if err != nil {
+		return
+	}
+
+	for {
+		if pc.Choked {
+			err = d.waitUnchoke(pc)
+			if err != nil {
+				dprintf("Peer %v: %v\n", addr, err)
+				return
+			}
+		}
+
+		select {
+		case <-d.done:
+			return
+		default:
+		}
+
+		// Every piece is checked against its hash before it's written, so
+		// the file is only reported as downloaded when all pieces are
+		// verified.
+		piece, ok := d.picker.pick(addr, pc.Bitfield)
+		if !ok {
+			// Peers downloading from us are kept even if they have nothing
+			// for us
+			if !d.picker.interesting(addr, pc.Bitfield) && !pc.IsInterested() {
+				dprintf("Peer %v has no piece we need\n", addr)
+				return
+			}
+			err = d.waitForPieces(pc)
+			if err != nil {
+				dprintf("Peer %v: %v\n", addr, err)
+				return
+			}
+			continue
+		}
+
+		work := pieceWork{index: piece, length: d.torrent.PieceSize(piece)}
+		data, err := d.downloadPieceFrom(pc, work)
+		if errors.Is(err, errChoked) || errors.Is(err, errPieceDone) {
+			d.picker.abort(piece)
+			continue
+		}
+		if err != nil {
+			d.picker.abort(piece)
+			dprintf("Peer %v failed on piece %v: %v\n", addr, piece, err)
+			return
+		}
+
+		err = d.torrent.verifyPiece(piece, data)
+		if err != nil {
+			dprintf("Peer %v: %v\n", addr, err)
+			d.picker.failed(piece, addr)
+			if d.recordHashFailure(addr) >= MaxHashFailures {
+				dprintf("Peer %v banned\n", addr)
+				return
+			}
+			continue
+		}
+
+		select {
+		case d.results <- pieceResult{index: piece, data: data, peer: addr}:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// Record that the peer sent a corrupted piece. Returns the number of failures
+// so far for the peer.
+func (d *download) recordHashFailure(addr netip.AddrPort) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.hashFailures[addr]++
+	return d.hashFailures[addr]
+}
+
+func (d *download) isBanned(addr netip.AddrPort) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.hashFailures[addr] >= MaxHashFailures
+}
+
+func (d *download) setConnected(addr netip.AddrPort, cp connectedPeer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.connected[addr] = cp
+}
+
+func (d *download) setDisconnected(addr netip.AddrPort) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.connected, addr)
+}
+
+// Periodically tell connected peers about the other peers we're connected to.
+func (d *download) runPex() {
+	ticker := time.NewTicker(PexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		d.mu.Lock()
+		peers := make([]netip.AddrPort, 0, len(d.connected))
+		handlers := make([]*utPex, 0, len(d.connected))
+		for addr, cp := range d.connected {
+			peers = append(peers, addr)
+			if cp.pex != nil {
+				handlers = append(handlers, cp.pex)
+			}
+		}
+		d.mu.Unlock()
+
+		for _, pex := range handlers {
+			err := pex.sendUpdate(peers)
+			if err != nil {
+				dprintf("Failed to send PEX message to %v: %v\n", pex.pc.Addr, err)
+			}
+		}
+	}
+}
+
+// Tell the connected peers that we have a new piece.
+func (d *download) sendHave(piece int) {
+	d.mu.Lock()
+	conns := make([]*peer.Conn, 0, len(d.connected))
+	for _, cp := range d.connected {
+		conns = append(conns, cp.pc)
+	}
+	d.mu.Unlock()
+
+	for _, pc := range conns {
+		err := pc.Send(peerwire.Have{Index: uint32(piece)})
+		if err != nil {
+			dprintf("Failed to send have to %v: %v\n", pc.Addr, err)
+		}
+	}
+}
+
+func (d *download) waitUnchoke(pc *peer.Conn) error {
+	pc.Conn.SetDeadline(time.Now().Add(PieceTimeout))
+	defer pc.Conn.SetDeadline(time.Time{})
+
+	for pc.Choked {
+		msg, err := pc.ReadMessage()
+		if err != nil {
+			return err
+		}
+		err = pc.HandleStateMsg(msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait for the peer to announce new pieces. Returns without error if the peer
+// sends nothing within PickRetryInterval, as pieces in progress on other peers
+// may have been returned to the picker in the meantime.
+func (d *download) waitForPieces(pc *peer.Conn) error {
+	pc.Conn.SetReadDeadline(time.Now().Add(PickRetryInterval))
+	defer pc.Conn.SetReadDeadline(time.Time{})
+
+	msg, err := pc.ReadMessage()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return pc.HandleStateMsg(msg)
+}
+
+// Download a single piece from the peer, keeping up to PipelineSize block
+// requests in flight. The peer has PieceTimeout to send each block, so large
+// pieces don't time out as long as blocks keep coming. In endgame mode, the
+// same piece may be downloaded from other peers: if one of them completes it
+// first, the requests still in flight are cancelled.
+func (d *download) downloadPieceFrom(pc *peer.Conn, work pieceWork) ([]byte, error) {
+	pc.Conn.SetDeadline(time.Now().Add(PieceTimeout))
+	defer pc.Conn.SetDeadline(time.Time{})
+
+	data := make([]byte, work.length)
+	numBlocks := (work.length + BlockMaxSize - 1) / BlockMaxSize
+	nextBlock := 0
+	received := 0
+	backlog := 0
+	receivedBlocks := peer.NewBitfield(numBlocks)
+
+	for received < numBlocks {
+		for backlog < PipelineSize && nextBlock < numBlocks {
+			err := pc.Send(work.blockRequest(nextBlock))
+			if err != nil {
+				return nil, err
+			}
+			nextBlock++
+			backlog++
+		}
+
+		msg, err := pc.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if d.picker.isDone(work.index) {
+			err = d.cancelRequests(pc, work, nextBlock, receivedBlocks)
+			if err != nil {
+				return nil, err
+			}
+			return nil, errPieceDone
+		}
+		err = pc.HandleStateMsg(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case peerwire.Choke:
+			return nil, errChoked
+		case peerwire.Piece:
+			blockOffset := int(msg.Begin)
+			block := msg.Block
+			if int(msg.Index) != work.index {
+				continue
+			}
+			// Blocks must be the ones we request: aligned to BlockMaxSize,
+			// with the length of the request
+			blockIndex := blockOffset / BlockMaxSize
+			if blockOffset%BlockMaxSize != 0 || blockIndex >= numBlocks ||
+				len(block) != int(work.blockRequest(blockIndex).Length) {
+				return nil, fmt.Errorf("%w: unexpected block: offset %v, length %v", peer.ErrUnexpectedMessage, blockOffset, len(block))
+			}
+			if receivedBlocks.Has(blockIndex) {
+				continue
+			}
+			copy(data[blockOffset:], block)
+			pc.RecordDownloaded(len(block))
+			pc.Conn.SetDeadline(time.Now().Add(PieceTimeout))
+			receivedBlocks.Set(blockIndex)
+			received++
+			backlog--
+		}
+	}
+
+	return data, nil
+}
+
+// Send cancel messages for the blocks of the piece that were requested, up to
+// nextBlock, but not received.
+func (d *download) cancelRequests(pc *peer.Conn, work pieceWork, nextBlock int, receivedBlocks peer.Bitfield) error {
+	for block := 0; block < nextBlock; block++ {
+		if receivedBlocks.Has(block) {
+			continue
+		}
+		req := work.blockRequest(block)
+		err := pc.Send(peerwire.Cancel{Index: req.Index, Begin: req.Begin, Length: req.Length})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peertest"
+	"github.com/codecrafters-io/bittorrent-starter-go/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+// Read n messages sent to the remote side of a connection.
+func readMessages(t *testing.T, remote *peer.Conn, n int) []peerwire.Message {
+	remote.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msgs := make([]peerwire.Message, 0, n)
+	for len(msgs) < n {
+		msg, err := remote.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// Start downloading a piece from the remote side of a loopback connection.
+// The error of the download is sent on the returned channel.
+func startPieceDownload(t *testing.T, d *download, work pieceWork) (*peer.Conn, chan error) {
+	pc, remote := peertest.Connect(t, 0)
+	pc.Choked = false
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := d.downloadPieceFrom(pc, work)
+		errs <- err
+	}()
+
+	for i, msg := range readMessages(t, remote, (work.length+BlockMaxSize-1)/BlockMaxSize) {
+		if msg != work.blockRequest(i) {
+			t.Fatalf("Expected request %v, got %v", work.blockRequest(i), msg)
+		}
+	}
+	return remote, errs
+}
+
+// In endgame mode, a peer downloading a piece that another peer finished
+// cancels its requests still in flight.
+func TestEndgameCancel(t *testing.T) {
+	d := &download{picker: newPiecePicker(1, nil)}
+	work := pieceWork{index: 0, length: 3 * BlockMaxSize}
+	remote, errs := startPieceDownload(t, d, work)
+
+	d.picker.finished(0)
+	err := remote.Send(peerwire.Have{Index: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, msg := range readMessages(t, remote, 3) {
+		req := work.blockRequest(i)
+		expected := peerwire.Cancel{Index: req.Index, Begin: req.Begin, Length: req.Length}
+		if msg != expected {
+			t.Fatalf("Expected %v, got %v", expected, msg)
+		}
+	}
+	if err := <-errs; err != errPieceDone {
+		t.Fatalf("Expected errPieceDone, got %v", err)
+	}
+}
+
+func TestDownloadPieceBlocks(t *testing.T) {
+	work := pieceWork{index: 0, length: 2*BlockMaxSize + 100}
+	piece := make([]byte, work.length)
+	for i := range piece {
+		piece[i] = byte(i)
+	}
+
+	// Blocks may come in any order
+	d := &download{picker: newPiecePicker(1, nil)}
+	remote, errs := startPieceDownload(t, d, work)
+	for _, i := range []int{2, 0, 1} {
+		req := work.blockRequest(i)
+		block := piece[req.Begin : req.Begin+req.Length]
+		err := remote.Send(peerwire.Piece{Index: 0, Begin: req.Begin, Block: block})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	unexpected := []peerwire.Piece{
+		{Index: 0, Begin: 1, Block: piece[1 : BlockMaxSize+1]},
+		{Index: 0, Begin: 0, Block: piece[:BlockMaxSize-1]},
+		{Index: 0, Begin: 2 * BlockMaxSize, Block: piece[:BlockMaxSize]},
+		{Index: 0, Begin: 3 * BlockMaxSize, Block: piece[:100]},
+	}
+	for _, msg := range unexpected {
+		d := &download{picker: newPiecePicker(1, nil)}
+		remote, errs := startPieceDownload(t, d, work)
+		err := remote.Send(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; !errors.Is(err, peer.ErrUnexpectedMessage) {
+			t.Fatalf("Begin %v, length %v: expected ErrUnexpectedMessage, got %v", msg.Begin, len(msg.Block), err)
+		}
+	}
+}
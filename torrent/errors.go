@@ -0,0 +1,8 @@
+package torrent
+
+import "errors"
+
+// A piece from a peer doesn't match its hash in the torrent. Like the errors
+// of the peer package, it's caused by a misbehaving peer: the peer is dropped,
+// and the download continues with other peers.
+var ErrPieceHashMismatch = errors.New("piece hash mismatch")
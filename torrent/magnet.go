@@ -0,0 +1,92 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A parsed magnet link:
+// magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker url>&xl=<length>
+type Magnet struct {
+	InfoHash    []byte
+	Trackers    []string
+	DisplayName string
+	ExactLength int // 0 if unknown
+}
+
+func ParseMagnet(link string) (*Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %v", link)
+	}
+
+	query := u.Query()
+	magnet := Magnet{
+		Trackers:    query["tr"],
+		DisplayName: query.Get("dn"),
+	}
+
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+
+		// The info hash is either 40 hex characters or 32 base32 characters
+		hash := xt[len("urn:btih:"):]
+		switch len(hash) {
+		case 40:
+			magnet.InfoHash, err = hex.DecodeString(hash)
+		case 32:
+			magnet.InfoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("invalid info hash length: %v", len(hash))
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if magnet.InfoHash == nil {
+		return nil, fmt.Errorf("magnet link has no BitTorrent info hash")
+	}
+
+	if xl := query.Get("xl"); xl != "" {
+		magnet.ExactLength, err = strconv.Atoi(xl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exact length: %v", xl)
+		}
+	}
+
+	return &magnet, nil
+}
+
+// Build a torrent from the magnet link. Only the info hash is known, the info
+// dict has to be fetched from peers with Client.FetchInfo. Each tracker gets
+// its own tier, so that all of them are asked for peers. Without trackers,
+// peers are found with the DHT.
+func (magnet *Magnet) Torrent() *Torrent {
+	tiers := make([][]string, 0, len(magnet.Trackers))
+	for _, tracker := range magnet.Trackers {
+		tiers = append(tiers, []string{tracker})
+	}
+
+	torrent := &Torrent{
+		TrackerTiers: tiers,
+		InfoHash:     magnet.InfoHash,
+		Info: Info{
+			Name:   magnet.DisplayName,
+			Length: magnet.ExactLength,
+		},
+	}
+	if len(magnet.Trackers) > 0 {
+		torrent.TrackerURL = magnet.Trackers[0]
+	}
+	return torrent
+}
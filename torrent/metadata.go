@@ -0,0 +1,198 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+// Metadata exchange (BEP 9): the info dict is transferred in pieces of 16 KiB
+// with the ut_metadata extension.
+const MetadataPieceSize = 16 * 1024
+
+// Refuse metadata larger than this
+const MaxMetadataSize = 16 * 1024 * 1024
+
+// ut_metadata message types
+const (
+	utMetadataRequest = 0
+	utMetadataData    = 1
+	utMetadataReject  = 2
+)
+
+// A ut_metadata message: d8:msg_typei<type>e5:piecei<piece>ee, followed by the
+// piece data in data messages
+type utMetadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"` // only in data messages
+}
+
+// Fetch the info dict of a torrent created from a magnet link from peers.
+func (c *Client) FetchInfo(ctx context.Context, torrent *Torrent) error {
+	peers, err := c.DiscoverPeers(ctx, torrent)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range peers {
+		raw, err := c.fetchMetadata(ctx, torrent, addr)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			dprintf("Failed to fetch metadata from %v: %v\n", addr, err)
+			continue
+		}
+
+		info, err := parseInfo(raw)
+		if err != nil {
+			dprintf("Invalid metadata from %v: %v\n", addr, err)
+			continue
+		}
+		torrent.Info = info
+		return nil
+	}
+
+	return fmt.Errorf("failed to fetch metadata from %v peers", len(peers))
+}
+
+// Fetch the info dict from a single peer. The result is checked against the
+// info hash.
+func (c *Client) fetchMetadata(ctx context.Context, torrent *Torrent, addr netip.AddrPort) (string, error) {
+	pc, err := c.Connect(ctx, torrent, addr)
+	if err != nil {
+		return "", err
+	}
+	defer pc.Close()
+	stop := peer.CloseOnCancel(ctx, pc)
+	defer stop()
+
+	if !pc.SupportsExtensions {
+		return "", fmt.Errorf("peer doesn't support extensions")
+	}
+	pc.Conn.SetDeadline(time.Now().Add(PieceTimeout))
+
+	handler := &utMetadata{pc: pc, infoHash: torrent.InfoHash}
+	pc.RegisterExtension(handler)
+	err = pc.SendExtHandshake()
+	if err != nil {
+		return "", err
+	}
+
+	for handler.result == nil {
+		msg, err := pc.ReadMessage()
+		if err != nil {
+			return "", err
+		}
+		err = pc.HandleStateMsg(msg)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return string(handler.result), nil
+}
+
+// Handler of the ut_metadata extension, downloading the metadata from the
+// peer.
+type utMetadata struct {
+	pc       *peer.Conn
+	infoHash []byte
+
+	metadata    []byte
+	received    peer.Bitfield
+	numPieces   int
+	numReceived int
+	result      []byte // the verified metadata once all pieces are received
+}
+
+func (m *utMetadata) Name() string {
+	return "ut_metadata"
+}
+
+// Request all pieces of the metadata once we know its size.
+func (m *utMetadata) OnHandshake(hs *peer.ExtHandshake) error {
+	if hs.M["ut_metadata"] == 0 {
+		return fmt.Errorf("peer doesn't support ut_metadata")
+	}
+	if hs.MetadataSize <= 0 || hs.MetadataSize > MaxMetadataSize {
+		return fmt.Errorf("invalid metadata size: %v", hs.MetadataSize)
+	}
+
+	m.metadata = make([]byte, hs.MetadataSize)
+	m.numPieces = (hs.MetadataSize + MetadataPieceSize - 1) / MetadataPieceSize
+	m.received = peer.NewBitfield(m.numPieces)
+	for piece := 0; piece < m.numPieces; piece++ {
+		request, err := encode.Marshal(utMetadataMsg{MsgType: utMetadataRequest, Piece: piece})
+		if err != nil {
+			return err
+		}
+		err = m.pc.SendExtended(m.Name(), request)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *utMetadata) OnMessage(payload []byte) error {
+	if m.metadata == nil {
+		return fmt.Errorf("%w: ut_metadata message before extension handshake", peer.ErrUnexpectedMessage)
+	}
+
+	// The decoder reads from r directly, so the piece data is left in r
+	r := bufio.NewReader(bytes.NewReader(payload))
+	var msg utMetadataMsg
+	err := decode.NewDecoder(r).Decode(&msg)
+	if err != nil {
+		return fmt.Errorf("%w: invalid ut_metadata message: %v", peer.ErrUnexpectedMessage, err)
+	}
+	piece := msg.Piece
+	if piece < 0 || piece >= m.numPieces {
+		return fmt.Errorf("%w: invalid metadata piece", peer.ErrUnexpectedMessage)
+	}
+
+	switch msg.MsgType {
+	case utMetadataRequest:
+		// We have no metadata to serve while downloading it
+		reject, err := encode.Marshal(utMetadataMsg{MsgType: utMetadataReject, Piece: piece})
+		if err != nil {
+			return err
+		}
+		return m.pc.SendExtended(m.Name(), reject)
+	case utMetadataReject:
+		return fmt.Errorf("peer rejected metadata request for piece %v", piece)
+	case utMetadataData:
+		data, _ := io.ReadAll(r)
+		offset := piece * MetadataPieceSize
+		if offset+len(data) > len(m.metadata) {
+			return fmt.Errorf("%w: metadata piece %v too long", peer.ErrUnexpectedMessage, piece)
+		}
+		copy(m.metadata[offset:], data)
+		if !m.received.Has(piece) {
+			m.received.Set(piece)
+			m.numReceived++
+		}
+	}
+
+	if m.numReceived == m.numPieces {
+		h := sha1.New()
+		h.Write(m.metadata)
+		if string(h.Sum(nil)) != string(m.infoHash) {
+			return fmt.Errorf("metadata doesn't match info hash")
+		}
+		m.result = m.metadata
+	}
+	return nil
+}
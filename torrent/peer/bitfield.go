@@ -0,0 +1,38 @@
+package peer
+
+// A bitfield of pieces as sent in bitfield messages: the high bit of the first
+// byte corresponds to piece 0.
+type Bitfield []byte
+
+func NewBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+func (bf Bitfield) Has(piece int) bool {
+	byteIdx := piece / 8
+	if piece < 0 || byteIdx >= len(bf) {
+		return false
+	}
+	return bf[byteIdx]>>(7-piece%8)&1 != 0
+}
+
+// Mark the piece as present. Pieces beyond the size of the bitfield are
+// ignored.
+func (bf Bitfield) Set(piece int) {
+	byteIdx := piece / 8
+	if piece < 0 || byteIdx >= len(bf) {
+		return
+	}
+	bf[byteIdx] |= 1 << (7 - piece%8)
+}
+
+// Number of pieces present, only counting the first numPieces pieces.
+func (bf Bitfield) Count(numPieces int) int {
+	n := 0
+	for p := 0; p < numPieces; p++ {
+		if bf.Has(p) {
+			n++
+		}
+	}
+	return n
+}
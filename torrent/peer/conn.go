@@ -0,0 +1,320 @@
+// Package peer implements connections to BitTorrent peers: the handshake, the
+// choking state of both sides, and the extension protocol (BEP 10).
+package peer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/peerwire"
+)
+
+// Time allowed to connect to a peer and exchange handshakes
+const DialTimeout = 5 * time.Second
+
+// A peer that doesn't accept a message within this time is dropped
+const WriteTimeout = 30 * time.Second
+
+// Support for the extension protocol (BEP 10) is signaled by bit 20 of the
+// reserved bytes, counting from the right, i.e. 0x10 in the 6th byte.
+const ExtensionReservedByte = 5
+const ExtensionReservedBit = 0x10
+
+// Our side of connections: the peer id sent in handshakes and the port we
+// accept connections on, advertised in extension handshakes.
+type Config struct {
+	PeerID [20]byte
+	Port   int
+}
+
+// State of a connection to a single peer.
+//
+// The exported fields other than Addr and PeerID are owned by the goroutine
+// reading messages, which updates them in HandleStateMsg.
+type Conn struct {
+	Addr     netip.AddrPort
+	PeerID   [20]byte // the peer's id from its handshake
+	Conn     net.Conn
+	Reader   *peerwire.Reader
+	Choked   bool            // whether the peer is choking us
+	Bitfield Bitfield        // pieces the peer has, sized for the torrent's pieces
+	OnHave   func(piece int) // called for each piece the peer announces, if set
+	// Called for the messages of the peer downloading from us: interested,
+	// not interested, request and cancel. They're ignored if not set.
+	OnUploadMsg func(msg peerwire.Message) error
+
+	SupportsExtensions bool // whether the peer supports the extension protocol (BEP 10)
+
+	config    Config
+	writer    *peerwire.Writer // messages can be sent from multiple goroutines
+	numPieces int              // 0 if unknown, e.g. for a magnet link before metadata is fetched
+
+	// Our side of the choking state, read by the choker from another goroutine
+	stateMu     sync.Mutex
+	choking     bool      // whether we are choking the peer
+	interested  bool      // whether the peer is interested in our pieces
+	uploaded    int64     // bytes of blocks sent to the peer
+	downloaded  int64     // bytes of blocks received from the peer
+	lastBlockAt time.Time // when the peer last sent us a block
+
+	ext extensionProtocol
+}
+
+// Transfer totals of a connection
+type Stats struct {
+	Uploaded    int64     // bytes of blocks sent to the peer
+	Downloaded  int64     // bytes of blocks received from the peer
+	LastBlockAt time.Time // when the peer last sent us a block, zero if never
+}
+
+// Our handshake for the torrent, advertising support for the extension
+// protocol.
+func OurHandshake(infoHash []byte, peerID [20]byte) *peerwire.Handshake {
+	h := peerwire.Handshake{PeerID: peerID}
+	h.Reserved[ExtensionReservedByte] |= ExtensionReservedBit
+	copy(h.InfoHash[:], infoHash)
+	return &h
+}
+
+func newConn(addr netip.AddrPort, conn net.Conn, peerHandshake *peerwire.Handshake,
+	numPieces int, config Config) *Conn {
+	return &Conn{
+		Addr:               addr,
+		PeerID:             peerHandshake.PeerID,
+		Conn:               conn,
+		Reader:             peerwire.NewReader(conn),
+		Choked:             true,
+		Bitfield:           NewBitfield(numPieces),
+		SupportsExtensions: peerHandshake.Reserved[ExtensionReservedByte]&ExtensionReservedBit != 0,
+		config:             config,
+		writer:             peerwire.NewWriter(conn),
+		numPieces:          numPieces,
+		choking:            true,
+	}
+}
+
+// Dial the peer and perform the handshake. The info hash in the response must
+// match ours. numPieces is the number of pieces of the torrent, 0 if unknown:
+// pieces the peer announces beyond it are rejected. Cancelling ctx aborts the
+// dial and the handshake, but not the returned connection.
+func Dial(ctx context.Context, addr netip.AddrPort, infoHash []byte,
+	numPieces int, config Config) (*Conn, error) {
+	dialer := net.Dialer{Timeout: DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	stop := CloseOnCancel(ctx, conn)
+	defer stop()
+
+	_, err = conn.Write(OurHandshake(infoHash, config.PeerID).Marshal())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	response, err := peerwire.ReadHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !bytes.Equal(response.InfoHash[:], infoHash) {
+		conn.Close()
+		return nil, fmt.Errorf("peer %v: %w", addr, ErrHandshakeMismatch)
+	}
+	dprintf("handshake with %v done\n", addr)
+
+	return newConn(addr, conn, response, numPieces, config), nil
+}
+
+// Perform the handshake of an incoming connection. The peer sends its
+// handshake first, and we only respond if it's for our info hash. numPieces is
+// as for Dial.
+func Accept(conn net.Conn, infoHash []byte, numPieces int, config Config) (*Conn, error) {
+	addr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	request, err := peerwire.ReadHandshake(conn)
+	if err != nil {
+		return nil, fmt.Errorf("peer %v: %w", addr, err)
+	}
+	if !bytes.Equal(request.InfoHash[:], infoHash) {
+		return nil, fmt.Errorf("peer %v: %w", addr, ErrHandshakeMismatch)
+	}
+
+	_, err = conn.Write(OurHandshake(infoHash, config.PeerID).Marshal())
+	if err != nil {
+		return nil, err
+	}
+	dprintf("handshake from %v done\n", addr)
+
+	return newConn(addr, conn, request, numPieces, config), nil
+}
+
+func (pc *Conn) Close() error {
+	return pc.Conn.Close()
+}
+
+// Close c when ctx is cancelled, which makes pending reads and writes on it
+// fail. Call the returned function to stop watching ctx; once it returns, c
+// is only closed if ctx was cancelled before.
+func CloseOnCancel(ctx context.Context, c io.Closer) func() {
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-exited
+	}
+}
+
+// Read the next message. A read that fails on a deadline can be retried
+// without losing the message.
+func (pc *Conn) ReadMessage() (peerwire.Message, error) {
+	return pc.Reader.ReadMessage()
+}
+
+// Send a message. It's safe to send from multiple goroutines.
+func (pc *Conn) Send(msg peerwire.Message) error {
+	pc.Conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	return pc.writer.WriteMessage(msg)
+}
+
+// Update the connection state for messages that aren't tied to a particular
+// request: choke, unchoke, have and bitfield. Extended messages are dispatched
+// to the extension handlers, and messages about our uploads to OnUploadMsg.
+// Have and bitfield messages for pieces the torrent doesn't have return
+// ErrUnexpectedMessage; they're ignored if the number of pieces is unknown.
+func (pc *Conn) HandleStateMsg(msg peerwire.Message) error {
+	switch msg := msg.(type) {
+	case peerwire.Choke:
+		pc.Choked = true
+	case peerwire.Unchoke:
+		pc.Choked = false
+	case peerwire.Have:
+		if pc.numPieces == 0 {
+			return nil
+		}
+		if int64(msg.Index) >= int64(pc.numPieces) {
+			return fmt.Errorf("%w: have for piece %v of %v", ErrUnexpectedMessage, msg.Index, pc.numPieces)
+		}
+		pc.addPiece(int(msg.Index))
+	case peerwire.Bitfield:
+		if pc.numPieces == 0 {
+			return nil
+		}
+		// Spare bits at the end must be cleared
+		bits := Bitfield(msg.Bits)
+		if len(bits) != len(pc.Bitfield) || bits.Count(8*len(bits)) != bits.Count(pc.numPieces) {
+			return fmt.Errorf("%w: bitfield of %v bytes for %v pieces",
+				ErrUnexpectedMessage, len(bits), pc.numPieces)
+		}
+		for piece := 0; piece < pc.numPieces; piece++ {
+			if bits.Has(piece) {
+				pc.addPiece(piece)
+			}
+		}
+	case peerwire.Extended:
+		return pc.handleExtendedMsg(msg.ExtendedID, msg.Payload)
+	case peerwire.Interested, peerwire.NotInterested, peerwire.Request, peerwire.Cancel:
+		if pc.OnUploadMsg != nil {
+			return pc.OnUploadMsg(msg)
+		}
+	}
+	return nil
+}
+
+func (pc *Conn) IsChoking() bool {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+
+	return pc.choking
+}
+
+// Choke or unchoke the peer, sending a message if the state changes.
+func (pc *Conn) SetChoking(choking bool) error {
+	pc.stateMu.Lock()
+	changed := pc.choking != choking
+	pc.choking = choking
+	pc.stateMu.Unlock()
+
+	if !changed {
+		return nil
+	}
+	if choking {
+		return pc.Send(peerwire.Choke{})
+	}
+	return pc.Send(peerwire.Unchoke{})
+}
+
+func (pc *Conn) IsInterested() bool {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+
+	return pc.interested
+}
+
+func (pc *Conn) SetInterested(interested bool) {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+
+	pc.interested = interested
+}
+
+func (pc *Conn) RecordUploaded(n int) {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+
+	pc.uploaded += int64(n)
+}
+
+func (pc *Conn) RecordDownloaded(n int) {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+
+	pc.downloaded += int64(n)
+	pc.lastBlockAt = time.Now()
+}
+
+func (pc *Conn) Stats() Stats {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+
+	return Stats{Uploaded: pc.uploaded, Downloaded: pc.downloaded, LastBlockAt: pc.lastBlockAt}
+}
+
+func (pc *Conn) HasPiece(piece int) bool {
+	return pc.Bitfield.Has(piece)
+}
+
+func (pc *Conn) addPiece(piece int) {
+	if pc.Bitfield.Has(piece) {
+		return
+	}
+	pc.Bitfield.Set(piece)
+	if pc.OnHave != nil {
+		pc.OnHave(piece)
+	}
+}
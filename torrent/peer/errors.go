@@ -0,0 +1,13 @@
+package peer
+
+import "errors"
+
+// Errors caused by a misbehaving peer. They are wrapped with details, check
+// them with errors.Is. The peer should be dropped.
+var (
+	// The peer's handshake is for another torrent
+	ErrHandshakeMismatch = errors.New("info hash mismatch in handshake")
+	// The peer sent a message that isn't valid at this point, e.g. a block we
+	// didn't request or a request for a piece we don't have
+	ErrUnexpectedMessage = errors.New("unexpected message")
+)
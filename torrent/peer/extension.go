@@ -0,0 +1,170 @@
+package peer
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/peerwire"
+)
+
+// Extension protocol (BEP 10) messages have message id 20. The payload starts
+// with a 1-byte extended message id, followed by the extension's payload.
+// Extended message id 0 is the extension handshake, a bencoded dict.
+const extHandshakeId = 0
+
+// Client name sent in the extension handshake
+const ClientVersion = "mybittorrent 0.1"
+
+// Number of outstanding requests we accept from a peer, sent in the extension
+// handshake
+const MaxPeerRequests = 250
+
+// An extension plugged into the extension protocol of a single connection.
+type ExtensionHandler interface {
+	// Name of the extension in the m dict of the handshake, e.g. ut_metadata
+	Name() string
+	// Called once the peer's extension handshake is received. The handler
+	// can start sending messages from then on, if the peer supports it.
+	OnHandshake(hs *ExtHandshake) error
+	// Called for each message of this extension, with the payload after the
+	// extended message id.
+	OnMessage(payload []byte) error
+}
+
+// Implemented by handlers that add fields to our extension handshake, such as
+// metadata_size.
+type HandshakeExtender interface {
+	ExtendHandshake(dict map[string]interface{})
+}
+
+// Fields of an extension handshake
+type ExtHandshake struct {
+	M            map[string]int // extension names to message ids, 0 means disabled
+	V            string         // client name and version
+	P            int            // listen port
+	Reqq         int            // number of outstanding requests accepted
+	MetadataSize int            // size of the info dict (BEP 9)
+	YourIP       []byte         // our IP as seen by the peer, 4 or 16 bytes
+}
+
+// Extension protocol state of a single connection.
+type extensionProtocol struct {
+	handlers []ExtensionHandler // index i is the handler for our message id i+1
+	// The peer's handshake, nil until received
+	peerHandshake *ExtHandshake
+}
+
+// Register a handler for an extension on this connection. Handlers must be
+// registered before the extension handshake is sent.
+func (pc *Conn) RegisterExtension(handler ExtensionHandler) {
+	pc.ext.handlers = append(pc.ext.handlers, handler)
+}
+
+// Send our extension handshake, advertising the registered extensions.
+func (pc *Conn) SendExtHandshake() error {
+	if !pc.SupportsExtensions {
+		return fmt.Errorf("peer doesn't support extensions")
+	}
+
+	m := make(map[string]interface{})
+	for i, handler := range pc.ext.handlers {
+		m[handler.Name()] = i + 1
+	}
+	dict := map[string]interface{}{
+		"m":    m,
+		"v":    ClientVersion,
+		"p":    pc.config.Port,
+		"reqq": MaxPeerRequests,
+	}
+	if ip := pc.Addr.Addr().Unmap(); ip.IsValid() {
+		dict["yourip"] = string(ip.AsSlice())
+	}
+	for _, handler := range pc.ext.handlers {
+		if extender, ok := handler.(HandshakeExtender); ok {
+			extender.ExtendHandshake(dict)
+		}
+	}
+
+	encoded, err := encode.Encode(dict)
+	if err != nil {
+		return err
+	}
+	return pc.Send(peerwire.Extended{ExtendedID: extHandshakeId, Payload: []byte(encoded)})
+}
+
+// Send a message of the named extension, using the message id from the peer's
+// handshake.
+func (pc *Conn) SendExtended(name string, payload []byte) error {
+	id := pc.PeerExtensionID(name)
+	if id == 0 {
+		return fmt.Errorf("peer doesn't support %v", name)
+	}
+	return pc.Send(peerwire.Extended{ExtendedID: uint8(id), Payload: payload})
+}
+
+// Message id of the named extension for the peer, 0 if the peer doesn't
+// support it or hasn't sent its handshake yet.
+func (pc *Conn) PeerExtensionID(name string) int {
+	if pc.ext.peerHandshake == nil {
+		return 0
+	}
+	return pc.ext.peerHandshake.M[name]
+}
+
+// Dispatch an extended message to the handshake parser or the handler of the
+// extension.
+func (pc *Conn) handleExtendedMsg(extendedId uint8, payload []byte) error {
+	id := int(extendedId)
+	if id == extHandshakeId {
+		hs, err := parseExtHandshake(payload)
+		if err != nil {
+			return err
+		}
+		pc.ext.peerHandshake = hs
+		dprintf("Extension handshake from %v: %v\n", pc.Addr, hs.M)
+
+		for _, handler := range pc.ext.handlers {
+			err = handler.OnHandshake(hs)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if id > len(pc.ext.handlers) {
+		// not an extension we advertised, ignore
+		return nil
+	}
+	return pc.ext.handlers[id-1].OnMessage(payload)
+}
+
+func parseExtHandshake(payload []byte) (*ExtHandshake, error) {
+	decoded, err := decode.Decode(string(payload))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("extension handshake is not a dict")
+	}
+
+	hs := ExtHandshake{M: make(map[string]int)}
+	m, _ := dict["m"].(map[string]interface{})
+	for name, id_raw := range m {
+		id, ok := id_raw.(int)
+		if ok && id > 0 && id < 256 {
+			hs.M[name] = id
+		}
+	}
+	hs.V, _ = dict["v"].(string)
+	hs.P, _ = dict["p"].(int)
+	hs.Reqq, _ = dict["reqq"].(int)
+	hs.MetadataSize, _ = dict["metadata_size"].(int)
+	if yourip, ok := dict["yourip"].(string); ok && (len(yourip) == 4 || len(yourip) == 16) {
+		hs.YourIP = []byte(yourip)
+	}
+
+	return &hs, nil
+}
@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// A peer that disconnected is handed out again after this long, times the
+// number of times it was retried already
+const PeerRetryInterval = 15 * time.Second
+
+// A peer is retried at most this many times in a row without sending us a
+// verified piece, then forgotten
+const MaxPeerRetries = 3
+
+// Maximum number of peers known to the pool, so that peer exchange can't make
+// it grow without bound. Further peers are ignored until some are forgotten.
+const MaxPoolPeers = 500
+
+// Candidate peers of a download, fed by trackers and peer exchange. Every peer
+// is handed out once, and again after a delay if retry is called when it
+// disconnects.
+type peerPool struct {
+	mu       sync.Mutex
+	known    map[netip.AddrPort]bool
+	pending  []netip.AddrPort // peers not handed out yet
+	added    chan struct{}    // signaled when new peers are added
+	retries  map[netip.AddrPort]int
+	numDelay int // peers waiting to be handed out again
+}
+
+func newPeerPool() *peerPool {
+	return &peerPool{
+		known:   make(map[netip.AddrPort]bool),
+		added:   make(chan struct{}, 1),
+		retries: make(map[netip.AddrPort]int),
+	}
+}
+
+// Add peers to the pool. Peers already known are ignored, and so are new
+// peers once the pool is full.
+func (pool *peerPool) add(peers []netip.AddrPort) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	numAdded := 0
+	for _, peer := range peers {
+		if !peer.IsValid() || peer.Port() == 0 || pool.known[peer] {
+			continue
+		}
+		if len(pool.known) >= MaxPoolPeers {
+			break
+		}
+		pool.known[peer] = true
+		pool.pending = append(pool.pending, peer)
+		numAdded++
+	}
+
+	if numAdded > 0 {
+		pool.signal()
+	}
+}
+
+// Wake up the download waiting for peers
+func (pool *peerPool) signal() {
+	select {
+	case pool.added <- struct{}{}:
+	default:
+	}
+}
+
+// Take the next peer not handed out yet.
+func (pool *peerPool) next() (netip.AddrPort, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if len(pool.pending) == 0 {
+		return netip.AddrPort{}, false
+	}
+	peer := pool.pending[0]
+	pool.pending = pool.pending[1:]
+	return peer, true
+}
+
+// Hand out a peer that disconnected again later, unless it was retried
+// MaxPeerRetries times already, in which case it's forgotten to make room for
+// other peers. Returns whether it will be handed out again.
+func (pool *peerPool) retry(peer netip.AddrPort) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.retries[peer] >= MaxPeerRetries {
+		delete(pool.retries, peer)
+		delete(pool.known, peer)
+		return false
+	}
+	pool.retries[peer]++
+	pool.numDelay++
+
+	time.AfterFunc(time.Duration(pool.retries[peer])*PeerRetryInterval, func() {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+
+		pool.numDelay--
+		pool.pending = append(pool.pending, peer)
+		pool.signal()
+	})
+	return true
+}
+
+// Record that the peer sent a verified piece, so that it's retried again if
+// it disconnects.
+func (pool *peerPool) resetRetries(peer netip.AddrPort) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	delete(pool.retries, peer)
+}
+
+// Whether peers are left to hand out, now or after their retry delay.
+func (pool *peerPool) hasPeers() bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return len(pool.pending) > 0 || pool.numDelay > 0
+}
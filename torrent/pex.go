@@ -0,0 +1,209 @@
+package torrent
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/tracker"
+)
+
+// Peer exchange (BEP 11). A PEX message is a bencoded dict with the peers
+// connected and disconnected since the previous message:
+// - added, added6: peers in compact format (IPv4 and IPv6)
+// - added.f, added6.f: one byte of flags per added peer
+// - dropped, dropped6: peers in compact format
+//
+// Messages are sent at most once a minute, with at most PexMaxPeers added and
+// PexMaxPeers dropped peers each. Messages from a peer that arrive faster are
+// ignored, with some slack for timer jitter.
+const PexInterval = time.Minute
+const PexMaxPeers = 50
+const pexMinInterval = PexInterval - 5*time.Second
+
+// Flags of an added peer. The other flags, 0x04 for uTP and 0x08 for
+// holepunch support, don't matter to us as we only connect over TCP.
+const (
+	pexFlagEncryption = 0x01 // the peer prefers encrypted connections, which we don't support
+	pexFlagSeed       = 0x02 // the peer has all pieces
+	pexFlagReachable  = 0x10 // the sender connected to the peer, so it accepts incoming connections
+)
+
+// Handler of the ut_pex extension on a single connection.
+type utPex struct {
+	pc      *peer.Conn
+	onPeers func(peers []netip.AddrPort) // called with the peers added by the peer
+
+	mu           sync.Mutex
+	peerId       int                     // message id from the peer's handshake, 0 if not supported
+	lastSent     map[netip.AddrPort]bool // peers in the messages we sent so far
+	lastReceived time.Time               // when the last message from the peer was accepted
+}
+
+func (pex *utPex) Name() string {
+	return "ut_pex"
+}
+
+func (pex *utPex) OnHandshake(hs *peer.ExtHandshake) error {
+	pex.mu.Lock()
+	defer pex.mu.Unlock()
+
+	pex.peerId = hs.M[pex.Name()]
+	return nil
+}
+
+func (pex *utPex) OnMessage(payload []byte) error {
+	pex.mu.Lock()
+	if !pex.lastReceived.IsZero() && time.Since(pex.lastReceived) < pexMinInterval {
+		pex.mu.Unlock()
+		dprintf("PEX from %v: ignored, sent too soon\n", pex.pc.Addr)
+		return nil
+	}
+	pex.lastReceived = time.Now()
+	pex.mu.Unlock()
+
+	decoded, err := decode.Decode(string(payload))
+	if err != nil {
+		return err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("PEX message is not a dict")
+	}
+
+	// Dropped peers are ignored: they may still be reachable from us
+	peers := parsePexPeers(dict, "added", 4)
+	peers = append(peers, parsePexPeers(dict, "added6", 16)...)
+	if len(peers) > 2*PexMaxPeers {
+		peers = peers[:2*PexMaxPeers]
+	}
+	dprintf("PEX from %v: %v peers added\n", pex.pc.Addr, len(peers))
+
+	// The peers most likely to be useful are tried first
+	sort.SliceStable(peers, func(i, j int) bool {
+		return pexRank(peers[i].flags) > pexRank(peers[j].flags)
+	})
+	addrs := make([]netip.AddrPort, 0, len(peers))
+	for _, p := range peers {
+		addrs = append(addrs, p.addr)
+	}
+	pex.onPeers(addrs)
+	return nil
+}
+
+// A peer added in a PEX message, with its flags
+type pexPeer struct {
+	addr  netip.AddrPort
+	flags byte
+}
+
+// Parse the peers in compact format under key, and their flags under key.f.
+// Peers without flags get none.
+func parsePexPeers(dict map[string]interface{}, key string, addrLen int) []pexPeer {
+	compact, _ := dict[key].(string)
+	flags, _ := dict[key+".f"].(string)
+	addrs := tracker.ParseCompactPeers([]byte(compact), addrLen)
+
+	peers := make([]pexPeer, 0, len(addrs))
+	for i, addr := range addrs {
+		p := pexPeer{addr: addr}
+		if i < len(flags) {
+			p.flags = flags[i]
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Peers known to accept connections come first, then seeds. Peers preferring
+// encryption come last, as they may refuse our plaintext connections.
+func pexRank(flags byte) int {
+	rank := 0
+	if flags&pexFlagReachable != 0 {
+		rank += 2
+	}
+	if flags&pexFlagSeed != 0 {
+		rank++
+	}
+	if flags&pexFlagEncryption != 0 {
+		rank -= 4
+	}
+	return rank
+}
+
+// Tell the peer about the peers we're connected to now. Only changes since the
+// previous message are sent.
+func (pex *utPex) sendUpdate(connected []netip.AddrPort) error {
+	pex.mu.Lock()
+	defer pex.mu.Unlock()
+
+	if pex.peerId == 0 {
+		return nil
+	}
+
+	current := make(map[netip.AddrPort]bool)
+	added := make([]netip.AddrPort, 0)
+	for _, peer := range connected {
+		if peer == pex.pc.Addr {
+			continue
+		}
+		current[peer] = true
+		if !pex.lastSent[peer] && len(added) < PexMaxPeers {
+			added = append(added, peer)
+		}
+	}
+	dropped := make([]netip.AddrPort, 0)
+	for peer := range pex.lastSent {
+		if !current[peer] && len(dropped) < PexMaxPeers {
+			dropped = append(dropped, peer)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	added4 := tracker.EncodeCompactPeers(added, 4)
+	added6 := tracker.EncodeCompactPeers(added, 16)
+	msg, err := encode.Encode(map[string]interface{}{
+		"added":    string(added4),
+		"added.f":  string(pexFlags(len(added4) / 6)),
+		"added6":   string(added6),
+		"added6.f": string(pexFlags(len(added6) / 18)),
+		"dropped":  string(tracker.EncodeCompactPeers(dropped, 4)),
+		"dropped6": string(tracker.EncodeCompactPeers(dropped, 16)),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = pex.pc.Send(peerwire.Extended{ExtendedID: uint8(pex.peerId), Payload: []byte(msg)})
+	if err != nil {
+		return err
+	}
+
+	if pex.lastSent == nil {
+		pex.lastSent = make(map[netip.AddrPort]bool)
+	}
+	for _, peer := range added {
+		pex.lastSent[peer] = true
+	}
+	for _, peer := range dropped {
+		delete(pex.lastSent, peer)
+	}
+	return nil
+}
+
+// Flags for peers we tell others about: all of them are peers we connected to.
+func pexFlags(numPeers int) []byte {
+	flags := make([]byte, numPeers)
+	for i := range flags {
+		flags[i] = pexFlagReachable
+	}
+	return flags
+}
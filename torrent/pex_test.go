@@ -0,0 +1,89 @@
+package torrent
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/tracker"
+)
+
+func TestPexMessage(t *testing.T) {
+	var received [][]netip.AddrPort
+	pex := &utPex{pc: &peer.Conn{}, onPeers: func(peers []netip.AddrPort) {
+		received = append(received, peers)
+	}}
+
+	encrypted := netip.MustParseAddrPort("1.1.1.1:1")
+	plain := netip.MustParseAddrPort("2.2.2.2:2")
+	reachableSeed := netip.MustParseAddrPort("3.3.3.3:3")
+	noFlags := netip.MustParseAddrPort("[::4]:4")
+	msg, err := encode.Encode(map[string]interface{}{
+		"added":   string(tracker.EncodeCompactPeers([]netip.AddrPort{encrypted, plain, reachableSeed}, 4)),
+		"added.f": string([]byte{pexFlagEncryption, 0, pexFlagReachable | pexFlagSeed}),
+		"added6":  string(tracker.EncodeCompactPeers([]netip.AddrPort{noFlags}, 16)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pex.OnMessage([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]netip.AddrPort{{reachableSeed, plain, noFlags, encrypted}}
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("Mismatch! Expected: %v, result: %v", expected, received)
+	}
+
+	// A message within a minute of the previous one is ignored
+	err = pex.OnMessage([]byte(msg))
+	if err != nil || len(received) != 1 {
+		t.Fatalf("Expected the message to be ignored, got %v, %v", received, err)
+	}
+	pex.lastReceived = time.Now().Add(-PexInterval)
+	err = pex.OnMessage([]byte(msg))
+	if err != nil || len(received) != 2 {
+		t.Fatalf("Expected the message to be accepted, got %v, %v", received, err)
+	}
+}
+
+func TestPeerPoolLimits(t *testing.T) {
+	pool := newPeerPool()
+	peers := make([]netip.AddrPort, 0, MaxPoolPeers+100)
+	for i := 0; i < MaxPoolPeers+100; i++ {
+		peers = append(peers, netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 6881))
+	}
+	pool.add(peers)
+	pool.add(peers[:10])
+
+	numPeers := 0
+	for {
+		_, ok := pool.next()
+		if !ok {
+			break
+		}
+		numPeers++
+	}
+	if numPeers != MaxPoolPeers {
+		t.Fatalf("Expected %v peers, got %v", MaxPoolPeers, numPeers)
+	}
+
+	// A peer retried too often is forgotten, making room for another one
+	for i := 0; i < MaxPeerRetries; i++ {
+		if !pool.retry(peers[0]) {
+			t.Fatalf("Expected retry %v to be scheduled", i+1)
+		}
+	}
+	if pool.retry(peers[0]) {
+		t.Fatal("Expected the peer to be forgotten")
+	}
+	pool.add(peers[MaxPoolPeers:])
+	next, ok := pool.next()
+	if !ok || next != peers[MaxPoolPeers] {
+		t.Fatalf("Expected %v to be added, got %v", peers[MaxPoolPeers], next)
+	}
+}
@@ -0,0 +1,227 @@
+package torrent
+
+import (
+	"math/rand"
+	"net/netip"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+// The first pieces are picked at random rather than rarest-first, so that we
+// quickly have complete pieces to offer to other peers
+const RandomFirstPieces = 4
+
+// Piece priorities. Pieces with a higher priority are always picked first.
+const (
+	PriorityLow    = -1
+	PriorityNormal = 0
+	PriorityHigh   = 1
+)
+
+// Piece picker deciding which piece a peer should download next. It tracks
+// how many connected peers have each piece, from their bitfield and have
+// messages, and picks the rarest piece the peer has.
+//
+// Once every missing piece is being downloaded, the picker enters endgame mode:
+// idle peers are given pieces already in progress on other peers, so that the
+// last pieces don't wait on a slow peer. Whichever peer finishes a piece first
+// wins, and the others cancel their requests.
+type piecePicker struct {
+	mu           sync.Mutex
+	numPieces    int
+	availability []int // number of connected peers having each piece
+	priority     []int
+	done         peer.Bitfield
+	downloaders  []int // number of peers downloading each piece
+	numPicked    int   // pieces picked so far, for random-first
+	endgame      bool
+	// Peers that sent data failing the hash check for each piece. We avoid
+	// asking them for the piece again.
+	failedPeers map[int]map[netip.AddrPort]bool
+}
+
+func newPiecePicker(numPieces int, done peer.Bitfield) *piecePicker {
+	p := &piecePicker{
+		numPieces:    numPieces,
+		availability: make([]int, numPieces),
+		priority:     make([]int, numPieces),
+		done:         peer.NewBitfield(numPieces),
+		downloaders:  make([]int, numPieces),
+		failedPeers:  make(map[int]map[netip.AddrPort]bool),
+	}
+	copy(p.done, done)
+	return p
+}
+
+// Override the priority of a piece.
+func (p *piecePicker) setPriority(piece int, priority int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if piece >= 0 && piece < p.numPieces {
+		p.priority[piece] = priority
+	}
+}
+
+// Record that a peer has the piece, from a have or bitfield message.
+func (p *piecePicker) peerHas(piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if piece >= 0 && piece < p.numPieces {
+		p.availability[piece]++
+	}
+}
+
+// Forget the pieces of a peer that disconnected.
+func (p *piecePicker) removePeer(bf peer.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for piece := 0; piece < p.numPieces; piece++ {
+		if bf.Has(piece) && p.availability[piece] > 0 {
+			p.availability[piece]--
+		}
+	}
+}
+
+// Whether the piece can be downloaded from the peer now. Pieces already in
+// progress are only given out again in endgame mode.
+func (p *piecePicker) canPick(piece int, addr netip.AddrPort, bf peer.Bitfield) bool {
+	return !p.done.Has(piece) && (p.endgame || p.downloaders[piece] == 0) &&
+		bf.Has(piece) && !p.failedPeers[piece][addr]
+}
+
+// Whether every missing piece is being downloaded.
+func (p *piecePicker) allPicked() bool {
+	for piece := 0; piece < p.numPieces; piece++ {
+		if !p.done.Has(piece) && p.downloaders[piece] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Pick the next piece to download from the peer and mark it as in progress.
+// Returns false if the peer has no piece we need right now.
+func (p *piecePicker) pick(addr netip.AddrPort, bf peer.Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.endgame && p.allPicked() {
+		dprintf("Entering endgame mode\n")
+		p.endgame = true
+	}
+
+	best := -1
+	numTies := 0
+	randomFirst := p.numPicked < RandomFirstPieces
+	for piece := 0; piece < p.numPieces; piece++ {
+		if !p.canPick(piece, addr, bf) {
+			continue
+		}
+		cmp := 1
+		if best >= 0 {
+			cmp = p.compare(piece, best, randomFirst)
+		}
+		if cmp == 0 {
+			// Break ties at random, so that peers don't all pick the same
+			// piece
+			numTies++
+			if rand.Intn(numTies) == 0 {
+				best = piece
+			}
+		} else if cmp > 0 {
+			best = piece
+			numTies = 1
+		}
+	}
+
+	if best < 0 {
+		return 0, false
+	}
+	p.downloaders[best]++
+	p.numPicked++
+	return best, true
+}
+
+// Compare two pieces: positive if a should be picked before b, 0 if there's no
+// preference. In endgame mode, pieces with fewer peers downloading them come
+// first.
+func (p *piecePicker) compare(a int, b int, randomFirst bool) int {
+	if p.priority[a] != p.priority[b] {
+		return p.priority[a] - p.priority[b]
+	}
+	if p.downloaders[a] != p.downloaders[b] {
+		return p.downloaders[b] - p.downloaders[a]
+	}
+	if randomFirst {
+		return 0
+	}
+	return p.availability[b] - p.availability[a]
+}
+
+// Return an in-progress piece to the picker, e.g. when the peer downloading it
+// disconnects.
+func (p *piecePicker) abort(piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.downloaders[piece] > 0 {
+		p.downloaders[piece]--
+	}
+}
+
+// Record that the peer sent the piece with a wrong hash, and return it to the
+// picker for other peers.
+func (p *piecePicker) failed(piece int, addr netip.AddrPort) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.downloaders[piece] > 0 {
+		p.downloaders[piece]--
+	}
+	if p.failedPeers[piece] == nil {
+		p.failedPeers[piece] = make(map[netip.AddrPort]bool)
+	}
+	p.failedPeers[piece][addr] = true
+}
+
+// Record that the piece is downloaded and verified.
+func (p *piecePicker) finished(piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.downloaders[piece] = 0
+	p.done.Set(piece)
+}
+
+// A copy of the bitfield of the pieces downloaded and verified.
+func (p *piecePicker) doneBitfield() peer.Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append(peer.Bitfield{}, p.done...)
+}
+
+func (p *piecePicker) isDone(piece int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.done.Has(piece)
+}
+
+// Whether the peer has a piece we still need, either not picked yet or being
+// downloaded from another peer, which may fail.
+func (p *piecePicker) interesting(addr netip.AddrPort, bf peer.Bitfield) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for piece := 0; piece < p.numPieces; piece++ {
+		if !p.done.Has(piece) && bf.Has(piece) && !p.failedPeers[piece][addr] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package torrent
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+func fullBitfield(numPieces int) peer.Bitfield {
+	bf := peer.NewBitfield(numPieces)
+	for piece := 0; piece < numPieces; piece++ {
+		bf.Set(piece)
+	}
+	return bf
+}
+
+// A picker past the random-first pieces, with the given availability of each
+// piece.
+func newTestPicker(availability ...int) *piecePicker {
+	p := newPiecePicker(len(availability), nil)
+	p.numPicked = RandomFirstPieces
+	for piece, n := range availability {
+		for i := 0; i < n; i++ {
+			p.peerHas(piece)
+		}
+	}
+	return p
+}
+
+// Pick n pieces for the peer, failing if fewer can be picked.
+func pickN(t *testing.T, p *piecePicker, addr netip.AddrPort, bf peer.Bitfield, n int) map[int]bool {
+	picked := make(map[int]bool)
+	for i := 0; i < n; i++ {
+		piece, ok := p.pick(addr, bf)
+		if !ok {
+			t.Fatalf("Expected pick %v to succeed", i+1)
+		}
+		picked[piece] = true
+	}
+	return picked
+}
+
+func TestPickerRarestFirst(t *testing.T) {
+	addr := netip.MustParseAddrPort("1.1.1.1:1")
+	p := newTestPicker(3, 1, 2, 3, 2, 3)
+	all := fullBitfield(6)
+
+	if picked := pickN(t, p, addr, all, 1); !picked[1] {
+		t.Fatalf("Expected the rarest piece 1, got %v", picked)
+	}
+	if picked := pickN(t, p, addr, all, 2); !picked[2] || !picked[4] {
+		t.Fatalf("Expected pieces 2 and 4, got %v", picked)
+	}
+	if picked := pickN(t, p, addr, all, 3); !picked[0] || !picked[3] || !picked[5] {
+		t.Fatalf("Expected pieces 0, 3 and 5, got %v", picked)
+	}
+
+	// Only the pieces the peer has are picked
+	p = newTestPicker(3, 1, 2, 3, 2, 3)
+	bf := peer.NewBitfield(6)
+	bf.Set(3)
+	bf.Set(5)
+	if picked := pickN(t, p, addr, bf, 2); !picked[3] || !picked[5] {
+		t.Fatalf("Expected pieces 3 and 5, got %v", picked)
+	}
+	if piece, ok := p.pick(addr, bf); ok {
+		t.Fatalf("Expected nothing to pick, got %v", piece)
+	}
+}
+
+func TestPickerRandomFirst(t *testing.T) {
+	addr := netip.MustParseAddrPort("1.1.1.1:1")
+	all := fullBitfield(8)
+
+	// The first pieces ignore availability
+	firstPicks := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		p := newPiecePicker(8, nil)
+		p.peerHas(0)
+		for piece := 1; piece < 8; piece++ {
+			p.peerHas(piece)
+			p.peerHas(piece)
+		}
+		piece, _ := p.pick(addr, all)
+		firstPicks[piece] = true
+	}
+	if len(firstPicks) < 2 {
+		t.Fatalf("Expected the first pick to be random, got %v", firstPicks)
+	}
+
+	// Afterwards, the rarest piece is picked
+	p := newPiecePicker(8, nil)
+	for piece := 0; piece < 7; piece++ {
+		p.peerHas(piece)
+		p.peerHas(piece)
+	}
+	p.peerHas(7)
+	bf := peer.NewBitfield(8)
+	for piece := 0; piece < 4; piece++ {
+		bf.Set(piece)
+	}
+	pickN(t, p, addr, bf, RandomFirstPieces)
+	if piece, ok := p.pick(addr, all); !ok || piece != 7 {
+		t.Fatalf("Expected the rarest piece 7, got %v, %v", piece, ok)
+	}
+}
+
+func TestPickerPriority(t *testing.T) {
+	addr := netip.MustParseAddrPort("1.1.1.1:1")
+	p := newTestPicker(1, 3, 3, 3)
+	p.setPriority(3, PriorityHigh)
+	p.setPriority(0, PriorityLow)
+	p.setPriority(4, PriorityHigh) // out of range, ignored
+	all := fullBitfield(4)
+
+	if picked := pickN(t, p, addr, all, 1); !picked[3] {
+		t.Fatalf("Expected the high priority piece 3, got %v", picked)
+	}
+	if picked := pickN(t, p, addr, all, 2); !picked[1] || !picked[2] {
+		t.Fatalf("Expected pieces 1 and 2, got %v", picked)
+	}
+	// The rarest piece comes last, as its priority is low
+	if picked := pickN(t, p, addr, all, 1); !picked[0] {
+		t.Fatalf("Expected the low priority piece 0, got %v", picked)
+	}
+}
+
+func TestPickerEndgame(t *testing.T) {
+	a := netip.MustParseAddrPort("1.1.1.1:1")
+	b := netip.MustParseAddrPort("2.2.2.2:2")
+	c := netip.MustParseAddrPort("3.3.3.3:3")
+	all := fullBitfield(2)
+	p := newTestPicker(3, 3)
+
+	pieceA, _ := p.pick(a, all)
+	pieceB, _ := p.pick(b, all)
+	if pieceA == pieceB || p.endgame {
+		t.Fatalf("Expected distinct pieces before endgame, got %v and %v", pieceA, pieceB)
+	}
+
+	// Once every piece is in progress, pieces are downloaded twice, the ones
+	// with the fewest downloaders first
+	pieceC, ok := p.pick(c, all)
+	if !ok || !p.endgame {
+		t.Fatal("Expected a duplicate pick in endgame mode")
+	}
+	pieceA2, _ := p.pick(a, all)
+	if pieceA2 == pieceC {
+		t.Fatalf("Expected the piece with a single downloader, got %v twice", pieceC)
+	}
+
+	// A finished piece isn't picked again
+	p.finished(pieceA)
+	if piece, ok := p.pick(c, all); !ok || piece == pieceA {
+		t.Fatalf("Expected the unfinished piece, got %v, %v", piece, ok)
+	}
+
+	// Nor is a piece picked again from a peer that sent it corrupted
+	p.failed(pieceB, b)
+	if piece, ok := p.pick(b, all); ok {
+		t.Fatalf("Expected nothing to pick, got %v", piece)
+	}
+	if p.interesting(b, all) || !p.interesting(a, all) {
+		t.Fatal("Expected only the peer that didn't fail to be interesting")
+	}
+}
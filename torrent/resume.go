@@ -0,0 +1,128 @@
+package torrent
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+// Progress of a download is persisted next to the output file, or next to the
+// directory of a multi-file torrent, so that an interrupted download can be
+// resumed. The state file is a bencoded dict:
+//
+//	d8:bitfield<bitfield of verified pieces>9:info hash20:<info hash>e
+func (torrent *Torrent) stateFilename(outputPath string) string {
+	return torrent.dataPath(outputPath) + ".state"
+}
+
+// Find the pieces of the output file that are already downloaded. The state
+// file is used when it belongs to this torrent and the files still hold the
+// pieces it claims. Otherwise the existing output file is scanned and every
+// piece is checked against its hash.
+func (torrent *Torrent) loadProgress(stateFile string, output *storage, infoHash []byte) peer.Bitfield {
+	progress, ok := readStateFile(stateFile, infoHash)
+	if ok && len(progress) == len(peer.NewBitfield(torrent.NumPieces())) && torrent.piecesOnDisk(output, progress) {
+		dprintf("Resuming from state file, %v/%v pieces done\n",
+			progress.Count(torrent.NumPieces()), torrent.NumPieces())
+		return progress
+	}
+
+	progress = torrent.scanPieces(output)
+	dprintf("Scanned existing output file, %v/%v pieces done\n",
+		progress.Count(torrent.NumPieces()), torrent.NumPieces())
+
+	return progress
+}
+
+// Whether the files are long enough to hold the pieces of progress. Files
+// deleted or truncated after the state file was written are recreated empty or
+// left short by openStorage, so the state file doesn't describe them anymore.
+func (torrent *Torrent) piecesOnDisk(s *storage, progress peer.Bitfield) bool {
+	sizes, err := s.fileSizes()
+	if err != nil {
+		return false
+	}
+	for p := 0; p < torrent.NumPieces(); p++ {
+		offset := int64(p) * int64(torrent.Info.PieceLength)
+		if progress.Has(p) && !s.onDisk(sizes, offset, int64(torrent.PieceSize(p))) {
+			dprintf("Piece %v of the state file is missing on disk\n", p)
+			return false
+		}
+	}
+	return true
+}
+
+// Check every piece of the data against its hash. Returns the pieces that
+// pass.
+func (torrent *Torrent) scanPieces(data io.ReaderAt) peer.Bitfield {
+	progress := peer.NewBitfield(torrent.NumPieces())
+	for p := 0; p < torrent.NumPieces(); p++ {
+		piece := make([]byte, torrent.PieceSize(p))
+		_, err := data.ReadAt(piece, int64(p)*int64(torrent.Info.PieceLength))
+		if err != nil {
+			// a file is shorter than expected
+			continue
+		}
+		if torrent.checkPieceHash(p, piece) {
+			progress.Set(p)
+		}
+	}
+	return progress
+}
+
+func readStateFile(filename string, infoHash []byte) (peer.Bitfield, bool) {
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false
+	}
+
+	decoded, err := decode.Decode(string(bytes))
+	if err != nil {
+		return nil, false
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	stateInfoHash, ok := dict["info hash"].(string)
+	if !ok || stateInfoHash != string(infoHash) {
+		return nil, false
+	}
+	progress, ok := dict["bitfield"].(string)
+	if !ok {
+		return nil, false
+	}
+
+	return peer.Bitfield(progress), true
+}
+
+// Persist the progress. The state file is replaced atomically so an
+// interruption never leaves a partially written state file behind.
+func writeStateFile(filename string, infoHash []byte, progress peer.Bitfield) error {
+	encoded, err := encode.Encode(map[string]interface{}{
+		"info hash": string(infoHash),
+		"bitfield":  string(progress),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := filename + ".tmp"
+	err = os.WriteFile(tmpFilename, []byte(encoded), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+func removeStateFile(filename string) error {
+	err := os.Remove(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
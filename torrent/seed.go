@@ -0,0 +1,179 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+// Maximum number of incoming connections we serve at the same time
+const MaxIncomingConns = 50
+
+// A peer that sends nothing for this long is disconnected. Peers send
+// keep-alive messages every 2 minutes.
+const PeerIdleTimeout = 3 * time.Minute
+
+// Re-announce to the trackers this often while seeding
+const SeedAnnounceInterval = 30 * time.Minute
+
+// State shared between the connections of peers downloading from us.
+type seeder struct {
+	client   *Client
+	torrent  *Torrent
+	have     peer.Bitfield // verified pieces we can serve
+	uploader *uploader
+
+	mu       sync.Mutex
+	numConns int
+}
+
+// Serve the torrent data in path to other peers until an error occurs or ctx
+// is cancelled, which disconnects all peers. path is the output path the
+// torrent was downloaded to. The files are only read, and must all exist.
+// Every piece is checked against its hash on start, state file or not, and
+// only the pieces that pass are served, so a partial download can be seeded
+// too. At most uploadSlots peers are unchoked at a time.
+func (c *Client) Seed(ctx context.Context, torrent *Torrent, path string, uploadSlots int) error {
+	storage, err := torrent.openStorage(path, true)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	have := torrent.scanPieces(storage)
+	numHave := have.Count(torrent.NumPieces())
+	if numHave == 0 {
+		return fmt.Errorf("no verified pieces to seed in %v", path)
+	}
+	torrent.complete = numHave == torrent.NumPieces()
+
+	// Connections are closed and waited for when we return, before the
+	// storage is closed
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(c.Port))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	stop := peer.CloseOnCancel(ctx, listener)
+	defer stop()
+	dprintf("Seeding %v/%v pieces on %v\n", numHave, torrent.NumPieces(), listener.Addr())
+
+	s := seeder{
+		client:  c,
+		torrent: torrent,
+		have:    have,
+		uploader: &uploader{
+			torrent: torrent,
+			storage: storage,
+			has:     have.Has,
+			choker:  newChoker(uploadSlots, true),
+		},
+	}
+	go s.announceLoop(ctx)
+	go s.uploader.choker.run(ctx)
+
+	for {
+		conn, err := listener.Accept()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		if !s.addConn() {
+			dprintf("Too many connections, rejecting %v\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.removeConn()
+			s.servePeer(ctx, conn)
+		}()
+	}
+}
+
+// Periodically announce to the trackers so that new peers can find us, until
+// ctx is cancelled.
+func (s *seeder) announceLoop(ctx context.Context) {
+	ticker := time.NewTicker(SeedAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		_, err := s.client.announce(ctx, s.torrent)
+		if err != nil && ctx.Err() == nil {
+			dprintf("Announce failed: %v\n", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *seeder) addConn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.numConns >= MaxIncomingConns {
+		return false
+	}
+	s.numConns++
+	return true
+}
+
+func (s *seeder) removeConn() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.numConns--
+}
+
+// Serve a single incoming connection: tell the peer which pieces we have,
+// and answer its block requests while the choker keeps it unchoked.
+func (s *seeder) servePeer(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := peer.CloseOnCancel(ctx, conn)
+	defer stop()
+
+	pc, err := peer.Accept(conn, s.torrent.InfoHash, s.torrent.NumPieces(), s.client.peerConfig())
+	if err != nil {
+		dprintf("Rejected incoming connection from %v: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	if pc.SupportsExtensions {
+		err = pc.SendExtHandshake()
+		if err != nil {
+			return
+		}
+	}
+	err = pc.Send(peerwire.Bitfield{Bits: s.have})
+	if err != nil {
+		return
+	}
+
+	removePeer := s.uploader.addPeer(pc)
+	defer removePeer()
+
+	pc.Conn.SetReadDeadline(time.Now().Add(PeerIdleTimeout))
+	err = peerwire.Dispatch(pc.Reader, func(msg peerwire.Message) error {
+		pc.Conn.SetReadDeadline(time.Now().Add(PeerIdleTimeout))
+		return pc.HandleStateMsg(msg)
+	})
+	dprintf("Peer %v disconnected: %v\n", pc.Addr, err)
+}
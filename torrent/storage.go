@@ -0,0 +1,169 @@
+package torrent
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A file on disk holding the byte range [offset, offset+length) of the
+// torrent data.
+type storageFile struct {
+	file   *os.File
+	offset int64
+	length int64
+}
+
+// Storage maps offsets in the torrent data, i.e. the concatenation of all
+// files, onto the files on disk. A read or write can span multiple files.
+type storage struct {
+	files []storageFile
+}
+
+// Open or create the files of the torrent. For a single-file torrent, the data
+// is stored in outputPath. For a multi-file torrent, files are stored under the
+// directory outputPath/<info.Name>. If readOnly, e.g. to seed, the files must
+// exist already and aren't opened for writing.
+func (torrent *Torrent) openStorage(outputPath string, readOnly bool) (*storage, error) {
+	s := &storage{}
+
+	if !torrent.Info.IsMultiFile() {
+		file, err := openStorageFile(outputPath, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		s.files = append(s.files, storageFile{file: file, offset: 0, length: int64(torrent.Info.Length)})
+		return s, nil
+	}
+
+	root := torrent.dataPath(outputPath)
+	offset := int64(0)
+	for _, entry := range torrent.Info.Files {
+		path := filepath.Join(append([]string{root}, entry.Path...)...)
+		if !readOnly {
+			err := os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		file, err := openStorageFile(path, readOnly)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, storageFile{file: file, offset: offset, length: int64(entry.Length)})
+		offset += int64(entry.Length)
+	}
+
+	return s, nil
+}
+
+// The path of the torrent data: the file of a single-file torrent, or the
+// directory named after a multi-file torrent.
+func (torrent *Torrent) dataPath(outputPath string) string {
+	if !torrent.Info.IsMultiFile() {
+		return outputPath
+	}
+	return filepath.Join(outputPath, torrent.Info.Name)
+}
+
+func openStorageFile(path string, readOnly bool) (*os.File, error) {
+	if readOnly {
+		return os.Open(path)
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+}
+
+func (s *storage) Close() error {
+	var firstErr error
+	for _, f := range s.files {
+		err := f.file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Call fn for each part of the range [off, off+len(p)) that falls into a
+// single file, with the part of p and the offset within that file.
+func (s *storage) forEachSpan(p []byte, off int64, fn func(f storageFile, part []byte, fileOffset int64) (int, error)) (int, error) {
+	n := 0
+	for _, f := range s.files {
+		if len(p) == 0 {
+			break
+		}
+		if off >= f.offset+f.length || f.length == 0 {
+			continue
+		}
+
+		fileOffset := off - f.offset
+		partLen := f.length - fileOffset
+		if partLen > int64(len(p)) {
+			partLen = int64(len(p))
+		}
+
+		partN, err := fn(f, p[:partLen], fileOffset)
+		n += partN
+		if err != nil {
+			return n, err
+		}
+
+		p = p[partLen:]
+		off += partLen
+	}
+
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Sizes of the files on disk. A file is shorter than its length in the torrent
+// while it's being downloaded, or if it was truncated.
+func (s *storage) fileSizes() (map[*os.File]int64, error) {
+	sizes := make(map[*os.File]int64)
+	for _, f := range s.files {
+		stat, err := f.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		sizes[f.file] = stat.Size()
+	}
+	return sizes, nil
+}
+
+// Whether the files, with the given sizes on disk, extend over the range
+// [off, off+length) of the torrent data.
+func (s *storage) onDisk(sizes map[*os.File]int64, off int64, length int64) bool {
+	end := off + length
+	for _, f := range s.files {
+		if f.offset >= end {
+			break
+		}
+		if f.length == 0 || f.offset+f.length <= off {
+			continue
+		}
+		needed := f.length
+		if end < f.offset+f.length {
+			needed = end - f.offset
+		}
+		if sizes[f.file] < needed {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *storage) ReadAt(p []byte, off int64) (int, error) {
+	return s.forEachSpan(p, off, func(f storageFile, part []byte, fileOffset int64) (int, error) {
+		return f.file.ReadAt(part, fileOffset)
+	})
+}
+
+func (s *storage) WriteAt(p []byte, off int64) (int, error) {
+	return s.forEachSpan(p, off, func(f storageFile, part []byte, fileOffset int64) (int, error) {
+		return f.file.WriteAt(part, fileOffset)
+	})
+}
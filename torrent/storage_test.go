@@ -0,0 +1,161 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A multi-file torrent with the given file lengths, named "dist", with files
+// named after their index.
+func newTestStorageTorrent(lengths ...int) *Torrent {
+	info := Info{Name: "dist", PieceLength: 4, Files: []FileEntry{}}
+	for i, length := range lengths {
+		info.Files = append(info.Files, FileEntry{Length: length, Path: []string{string(rune('a' + i))}})
+		info.Length += length
+	}
+	return &Torrent{Info: info}
+}
+
+type span struct {
+	file       int64 // offset of the file in the torrent data
+	fileOffset int64
+	length     int
+}
+
+func TestForEachSpan(t *testing.T) {
+	// files at [0, 5), [5, 5), [5, 8), [8, 16), [16, 16)
+	torrent := newTestStorageTorrent(5, 0, 3, 8, 0)
+	s, err := torrent.openStorage(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		name     string
+		off      int64
+		length   int
+		expected []span
+		err      error
+	}{
+		{"within a file", 1, 3, []span{{0, 1, 3}}, nil},
+		{"whole file", 0, 5, []span{{0, 0, 5}}, nil},
+		{"straddling a zero-length file", 3, 4, []span{{0, 3, 2}, {5, 0, 2}}, nil},
+		{"at the start of a file after a zero-length file", 5, 2, []span{{5, 0, 2}}, nil},
+		{"spanning three files", 4, 8, []span{{0, 4, 1}, {5, 0, 3}, {8, 0, 4}}, nil},
+		{"up to the end", 10, 6, []span{{8, 2, 6}}, nil},
+		{"everything", 0, 16, []span{{0, 0, 5}, {5, 0, 3}, {8, 0, 8}}, nil},
+		{"past the end", 14, 4, []span{{8, 6, 2}}, io.EOF},
+		{"after the end", 16, 1, nil, io.EOF},
+		{"empty", 3, 0, nil, nil},
+	}
+	for _, test := range tests {
+		var spans []span
+		n, err := s.forEachSpan(make([]byte, test.length), test.off, func(f storageFile, part []byte, fileOffset int64) (int, error) {
+			spans = append(spans, span{f.offset, fileOffset, len(part)})
+			return len(part), nil
+		})
+		if !reflect.DeepEqual(spans, test.expected) || err != test.err {
+			t.Errorf("%v: expected %v, %v, got %v, %v", test.name, test.expected, test.err, spans, err)
+		}
+		expectedN := 0
+		for _, span := range test.expected {
+			expectedN += span.length
+		}
+		if n != expectedN {
+			t.Errorf("%v: expected %v bytes, got %v", test.name, expectedN, n)
+		}
+	}
+}
+
+func TestStorageReadWrite(t *testing.T) {
+	torrent := newTestStorageTorrent(5, 0, 3, 8, 0)
+	dir := t.TempDir()
+	s, err := torrent.openStorage(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Blocks straddling file boundaries are split between the files
+	data := []byte("0123456789abcdef")
+	for off := 0; off < len(data); off += 6 {
+		end := off + 6
+		if end > len(data) {
+			end = len(data)
+		}
+		_, err = s.WriteAt(data[off:end], int64(off))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectedFiles := map[string]string{"a": "01234", "b": "", "c": "567", "d": "89abcdef", "e": ""}
+	for name, expected := range expectedFiles {
+		contents, err := os.ReadFile(filepath.Join(dir, "dist", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected {
+			t.Fatalf("Mismatch for %v! Expected: %q, result: %q", name, expected, contents)
+		}
+	}
+
+	p := make([]byte, 10)
+	n, err := s.ReadAt(p, 3)
+	if err != nil || n != 10 || !bytes.Equal(p, data[3:13]) {
+		t.Fatalf("Expected %q, got %q, %v", data[3:13], p[:n], err)
+	}
+
+	// A file shorter than expected fails the read, so the piece isn't counted
+	// as downloaded
+	err = os.Truncate(filepath.Join(dir, "dist", "c"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = s.ReadAt(p, 3)
+	if !errors.Is(err, io.EOF) || n != 3 {
+		t.Fatalf("Expected io.EOF after 3 bytes, got %v, %v", n, err)
+	}
+}
+
+func TestStorageOnDisk(t *testing.T) {
+	// files at [0, 5), [5, 5), [5, 8), [8, 16), [16, 16)
+	torrent := newTestStorageTorrent(5, 0, 3, 8, 0)
+	dir := t.TempDir()
+	s, err := torrent.openStorage(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = s.WriteAt(make([]byte, 10), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes, err := s.fileSizes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		off      int64
+		length   int64
+		expected bool
+	}{
+		{0, 5, true},
+		{3, 7, true},
+		{9, 1, true},
+		{9, 2, false},
+		{12, 4, false},
+		{0, 16, false},
+	}
+	for _, test := range tests {
+		if result := s.onDisk(sizes, test.off, test.length); result != test.expected {
+			t.Errorf("[%v, %v): expected %v, got %v", test.off, test.off+test.length, test.expected, result)
+		}
+	}
+}
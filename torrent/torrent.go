@@ -0,0 +1,395 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+	"github.com/codecrafters-io/bittorrent-starter-go/encode"
+	"github.com/codecrafters-io/bittorrent-starter-go/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+// Number of block requests kept in flight to a peer
+const PipelineSize = 5
+
+// Blocks are requested from peers in this size
+const BlockMaxSize = 16 * 1024
+
+// The info dict of a torrent, describing its files and pieces.
+type Info struct {
+	Length      int // total length of all files
+	Name        string
+	PieceLength int
+	Pieces      [](string)  // SHA-1 of each piece, binary format, not hex format
+	Files       []FileEntry // nil for single-file torrents
+	// Peers may only come from the trackers, not from the DHT or peer
+	// exchange (BEP 27)
+	Private bool
+	raw     string // the info dict exactly as encoded in the torrent file, if parsed from one
+}
+
+// A file in a multi-file torrent
+type FileEntry struct {
+	Length int
+	Path   []string // path components relative to the directory named after Info.Name
+}
+
+func (info *Info) IsMultiFile() bool {
+	return info.Files != nil
+}
+
+// The info dict as encoded in a torrent file:
+// d[5:filesl<file>...e][6:lengthi<length>e]4:name<name>12:piece lengthi<piece length>e6:pieces<hashes>e
+type infoDict struct {
+	Files       []fileDict `bencode:"files,omitempty"`
+	Length      *int       `bencode:"length"` // nil for multi-file torrents
+	Name        string     `bencode:"name"`
+	PieceLength int        `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"` // concatenated 20-byte SHA-1 hashes
+	Private     bool       `bencode:"private,omitempty"`
+	Source      string     `bencode:"source,omitempty"`
+}
+
+// A file of a multi-file info dict: d6:lengthi<length>e4:pathl<component>...ee
+type fileDict struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+// A torrent file. The info dict is kept encoded, as its exact bytes are hashed.
+type metainfo struct {
+	Announce     string            `bencode:"announce"`
+	AnnounceList [][]string        `bencode:"announce-list"`
+	Info         decode.RawMessage `bencode:"info"`
+}
+
+// The info hash is the SHA-1 of the encoded info dict. When the info dict was
+// parsed from a torrent file, the original bytes are hashed, so keys we don't
+// model (private, source, ...) are covered as well.
+func (info *Info) hash() ([]byte, error) {
+	if info.raw != "" {
+		h := sha1.New()
+		h.Write([]byte(info.raw))
+		return h.Sum(nil), nil
+	}
+
+	dict := infoDict{
+		Name:        info.Name,
+		PieceLength: info.PieceLength,
+		Pieces:      strings.Join(info.Pieces, ""),
+		Private:     info.Private,
+	}
+	if info.IsMultiFile() {
+		for _, file := range info.Files {
+			dict.Files = append(dict.Files, fileDict{Length: file.Length, Path: file.Path})
+		}
+	} else {
+		dict.Length = &info.Length
+	}
+
+	encoded_info, err := encode.Marshal(dict)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	h := sha1.New()
+	h.Write(encoded_info)
+	info_hash := h.Sum(nil)
+
+	return info_hash, nil
+}
+
+// A torrent, parsed from a torrent file or a magnet link.
+type Torrent struct {
+	TrackerURL   string
+	TrackerTiers [][]string // tiers of tracker URLs from announce-list (BEP 12)
+	InfoHash     []byte
+	Info         Info // only the info hash is known for a magnet link until metadata is fetched
+	complete     bool // whether we have all pieces and are seeding
+	// Guards TrackerTiers, reordered after each announce while a download and
+	// a seed of the torrent may announce concurrently
+	trackersMu sync.Mutex
+}
+
+// Parse the contents of a torrent file.
+func Parse(data []byte) (*Torrent, error) {
+	var file metainfo
+	err := decode.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(file.Info) == 0 {
+		return nil, fmt.Errorf("torrent has no info dict")
+	}
+	info, err := parseInfo(string(file.Info))
+	if err != nil {
+		return nil, err
+	}
+	infoHash, err := info.hash()
+	if err != nil {
+		return nil, err
+	}
+
+	torrent := Torrent{
+		TrackerURL:   file.Announce,
+		TrackerTiers: shuffleTiers(file.AnnounceList),
+		InfoHash:     infoHash,
+		Info:         info,
+	}
+	if len(torrent.TrackerTiers) == 0 {
+		if file.Announce == "" {
+			return nil, fmt.Errorf("torrent has no tracker")
+		}
+		torrent.TrackerTiers = [][]string{{file.Announce}}
+	}
+
+	return &torrent, nil
+}
+
+// Parse an encoded info dict, as found in a torrent file or received from
+// peers via metadata exchange.
+func parseInfo(raw string) (Info, error) {
+	var dict infoDict
+	err := decode.Unmarshal([]byte(raw), &dict)
+	if err != nil {
+		return Info{}, fmt.Errorf("invalid info dict: %w", err)
+	}
+
+	if dict.PieceLength <= 0 {
+		return Info{}, fmt.Errorf("invalid piece length")
+	}
+	if len(dict.Pieces)%20 != 0 {
+		return Info{}, fmt.Errorf("invalid pieces")
+	}
+
+	pieces := make([](string), 0)
+	for i := 0; i < len(dict.Pieces); i += 20 {
+		pieceHash := (dict.Pieces[i : i+20])
+		pieces = append(pieces, pieceHash)
+	}
+
+	info := Info{
+		Name:        dict.Name,
+		PieceLength: dict.PieceLength,
+		Pieces:      pieces,
+		Private:     dict.Private,
+		raw:         raw,
+	}
+
+	if dict.Files != nil {
+		// multi-file
+		if !isSafePathComponent(dict.Name) {
+			return Info{}, fmt.Errorf("invalid name: %q", dict.Name)
+		}
+		info.Files, err = parseFiles(dict.Files)
+		if err != nil {
+			return Info{}, err
+		}
+		for _, file := range info.Files {
+			info.Length += file.Length
+		}
+	} else {
+		if dict.Length == nil {
+			return Info{}, fmt.Errorf("info dict has neither length nor files")
+		}
+		info.Length = *dict.Length
+	}
+
+	if (info.Length+dict.PieceLength-1)/dict.PieceLength != len(pieces) {
+		return Info{}, fmt.Errorf("number of pieces doesn't match length")
+	}
+
+	return info, nil
+}
+
+// Drop empty URLs and tiers from announce-list, and shuffle the trackers
+// within each tier. Returns nil if announce-list has no URL.
+func shuffleTiers(announceList [][]string) [][]string {
+	tiers := make([][]string, 0, len(announceList))
+	for _, urls := range announceList {
+		tier := make([]string, 0, len(urls))
+		for _, url := range urls {
+			if url != "" {
+				tier = append(tier, url)
+			}
+		}
+		if len(tier) == 0 {
+			continue
+		}
+		rand.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+		tiers = append(tiers, tier)
+	}
+
+	if len(tiers) == 0 {
+		return nil
+	}
+	return tiers
+}
+
+// Check the files of a multi-file info dict.
+func parseFiles(fileDicts []fileDict) ([]FileEntry, error) {
+	files := make([]FileEntry, 0, len(fileDicts))
+	for _, file := range fileDicts {
+		if file.Length < 0 {
+			return nil, fmt.Errorf("invalid file length")
+		}
+		if len(file.Path) == 0 {
+			return nil, fmt.Errorf("invalid file path")
+		}
+		for _, component := range file.Path {
+			if !isSafePathComponent(component) {
+				return nil, fmt.Errorf("invalid file path component: %q", component)
+			}
+		}
+		files = append(files, FileEntry{Length: file.Length, Path: file.Path})
+	}
+
+	return files, nil
+}
+
+// Reject path components that could escape the download directory.
+func isSafePathComponent(component string) bool {
+	return component != "" && component != "." && component != ".." &&
+		!strings.ContainsAny(component, "/\\\x00")
+}
+
+func (torrent *Torrent) NumPieces() int {
+	return len(torrent.Info.Pieces)
+}
+
+// Size of the piece in bytes. Only the last piece can be shorter than
+// info.PieceLength.
+func (torrent *Torrent) PieceSize(piece int) int {
+	if piece < torrent.NumPieces()-1 {
+		return torrent.Info.PieceLength
+	}
+	return torrent.Info.Length - piece*torrent.Info.PieceLength
+}
+
+// Check the piece data against the piece hash in the info dictionary.
+func (torrent *Torrent) checkPieceHash(piece int, data []byte) bool {
+	h := sha1.New()
+	h.Write(data)
+	return string(h.Sum(nil)) == torrent.Info.Pieces[piece]
+}
+
+// Like checkPieceHash, but returns ErrPieceHashMismatch if the hash doesn't
+// match.
+func (torrent *Torrent) verifyPiece(piece int, data []byte) error {
+	if !torrent.checkPieceHash(piece, data) {
+		return fmt.Errorf("%w: piece %v", ErrPieceHashMismatch, piece)
+	}
+	return nil
+}
+
+// Assume handshake, bitfield, interested, unchoke are done already. The
+// connection is closed if ctx is cancelled.
+func (torrent *Torrent) downloadPieceCore(ctx context.Context, piece int, pc *peer.Conn) ([]byte, error) {
+	stop := peer.CloseOnCancel(ctx, pc)
+	defer stop()
+
+	d := download{
+		torrent: torrent,
+		picker:  newPiecePicker(torrent.NumPieces(), nil),
+	}
+	data, err := d.downloadPieceFrom(pc, pieceWork{index: piece, length: torrent.PieceSize(piece)})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return data, err
+}
+
+// Connect to the peer and exchange messages required before starting downloading pieces.
+// The caller should close the connection when finished. The connection is
+// closed if ctx is cancelled before it's ready.
+func (c *Client) prepareForDownload(ctx context.Context, torrent *Torrent, addr netip.AddrPort) (*peer.Conn, error) {
+	dprintf("Dialing peer %v...\n", addr)
+	pc, err := c.Connect(ctx, torrent, addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := peer.CloseOnCancel(ctx, pc)
+	defer stop()
+
+	err = pc.Send(peerwire.Interested{})
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	dprintf("interested message sent\n")
+
+	// The bitfield, have and extension messages may come in any order before
+	// the unchoke message
+	d := download{torrent: torrent}
+	err = d.waitUnchoke(pc)
+	if ctx.Err() != nil {
+		pc.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	dprintf("unchoke message received\n")
+
+	return pc, nil
+}
+
+// Download a single piece. Peers are tried in random order until one of them
+// sends the piece with the right hash.
+func (c *Client) DownloadPiece(ctx context.Context, torrent *Torrent, piece int) ([]byte, error) {
+	if piece < 0 || piece >= torrent.NumPieces() {
+		return nil, fmt.Errorf("invalid piece index: %v", piece)
+	}
+
+	peers, err := c.DiscoverPeers(ctx, torrent)
+	if err != nil {
+		return nil, err
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers found")
+	}
+
+	var lastErr error
+	for _, i := range rand.Perm(len(peers)) {
+		pieceData, err := c.downloadPieceFromPeer(ctx, torrent, piece, peers[i])
+		if err == nil {
+			return pieceData, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		dprintf("Peer %v failed on piece %v: %v\n", peers[i], piece, err)
+		lastErr = err
+	}
+	return nil, fmt.Errorf("failed to download piece %v from %v peers: %w", piece, len(peers), lastErr)
+}
+
+func (c *Client) downloadPieceFromPeer(ctx context.Context, torrent *Torrent, piece int, addr netip.AddrPort) ([]byte, error) {
+	pc, err := c.prepareForDownload(ctx, torrent, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	if !pc.HasPiece(piece) {
+		return nil, fmt.Errorf("peer doesn't have piece %v", piece)
+	}
+	pieceData, err := torrent.downloadPieceCore(ctx, piece, pc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = torrent.verifyPiece(piece, pieceData)
+	if err != nil {
+		return nil, err
+	}
+	return pieceData, nil
+}
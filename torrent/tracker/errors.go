@@ -0,0 +1,23 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A tracker responded with an error. Matches ErrFailure with errors.Is; use
+// errors.As to get the reason.
+var ErrFailure = errors.New("tracker failure")
+
+type Error struct {
+	Tracker string // URL or address of the tracker
+	Reason  string // failure reason sent by the tracker
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tracker %v: %v", e.Tracker, e.Reason)
+}
+
+func (e *Error) Unwrap() error {
+	return ErrFailure
+}
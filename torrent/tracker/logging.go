@@ -0,0 +1,12 @@
+package tracker
+
+import "log"
+
+// Debug logging to the standard logger, off by default
+var Debug = false
+
+func dprintf(format string, a ...interface{}) {
+	if Debug {
+		log.Printf(format, a...)
+	}
+}
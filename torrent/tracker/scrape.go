@@ -0,0 +1,133 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Maximum number of info hashes in a single HTTP scrape request, to keep the
+// URL reasonably short
+const httpMaxScrapeHashes = 50
+
+// Swarm statistics for a single torrent
+type ScrapeResult struct {
+	Seeders   int `bencode:"complete"`
+	Completed int `bencode:"downloaded"` // number of times the torrent was downloaded
+	Leechers  int `bencode:"incomplete"`
+}
+
+// Response of an HTTP tracker to a scrape, with results keyed by info hash
+type scrapeResponse struct {
+	FailureReason string                  `bencode:"failure reason"`
+	Files         map[string]ScrapeResult `bencode:"files"`
+}
+
+// Ask the tracker for swarm statistics of the given torrents. Results are keyed
+// by the info hash (binary format). Torrents unknown to the tracker are left
+// out of the results. Each request to the tracker fails after Timeout.
+func Scrape(ctx context.Context, trackerUrl string, infoHashes [][]byte) (map[string]ScrapeResult, error) {
+	u, err := url.Parse(trackerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(ctx, trackerUrl, infoHashes)
+	case "udp":
+		tracker, err := getUDPTracker(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		results, err := tracker.scrape(ctx, infoHashes)
+		if err != nil {
+			return nil, err
+		}
+
+		res := make(map[string]ScrapeResult)
+		for i, infoHash := range infoHashes {
+			res[string(infoHash)] = results[i]
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol: %v", u.Scheme)
+	}
+}
+
+// Derive the scrape URL from the announce URL. By convention, the last path
+// segment of the announce URL starts with "announce", which is replaced by
+// "scrape". Trackers that don't follow the convention don't support scraping.
+func scrapeURL(announceUrl string) (string, error) {
+	slash := strings.LastIndex(announceUrl, "/")
+	if slash < 0 || !strings.HasPrefix(announceUrl[slash+1:], "announce") {
+		return "", fmt.Errorf("tracker %v doesn't support scrape", announceUrl)
+	}
+
+	return announceUrl[:slash+1] + "scrape" + announceUrl[slash+1+len("announce"):], nil
+}
+
+func scrapeHTTP(ctx context.Context, announceUrl string, infoHashes [][]byte) (map[string]ScrapeResult, error) {
+	trackerUrl, err := scrapeURL(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]ScrapeResult)
+	for start := 0; start < len(infoHashes); start += httpMaxScrapeHashes {
+		end := start + httpMaxScrapeHashes
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+
+		decoded, err := scrapeHTTPBatch(ctx, trackerUrl, infoHashes[start:end])
+		if err != nil {
+			return nil, err
+		}
+		if decoded.FailureReason != "" {
+			return nil, &Error{Tracker: trackerUrl, Reason: decoded.FailureReason}
+		}
+		if decoded.Files == nil {
+			return nil, fmt.Errorf("scrape response has no files")
+		}
+
+		for infoHash, stats := range decoded.Files {
+			res[infoHash] = stats
+		}
+	}
+
+	return res, nil
+}
+
+// Send a single scrape request and decode the response:
+// d5:filesd20:<info hash>d8:completei<seeders>e10:downloadedi<completed>e10:incompletei<leechers>eeee
+func scrapeHTTPBatch(ctx context.Context, trackerUrl string, infoHashes [][]byte) (*scrapeResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", trackerUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	query := req.URL.Query()
+	for _, infoHash := range infoHashes {
+		query.Add("info_hash", string(infoHash))
+	}
+	req.URL.RawQuery = query.Encode()
+
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var decoded scrapeResponse
+	err = responseConfig.NewDecoder(resp.Body).Decode(&decoded)
+	if err != nil {
+		return nil, err
+	}
+	return &decoded, nil
+}
@@ -0,0 +1,213 @@
+// Package tracker implements the client side of the HTTP and UDP tracker
+// protocols: announcing to get peers of a torrent, and scraping swarm
+// statistics.
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/decode"
+)
+
+// A tracker that doesn't respond within this time is skipped. UDP requests
+// are retransmitted within that time, following the start of the BEP 15
+// schedule.
+const Timeout = 30 * time.Second
+
+// Limits for decoding HTTP tracker responses, which come from the network. An
+// announce response holds a few hundred peers and a scrape response a few
+// hundred torrents, well below these.
+var responseConfig = decode.Config{
+	MaxDepth:        8,
+	MaxStringLength: 1024 * 1024,
+	MaxLength:       4 * 1024 * 1024,
+}
+
+// Parameters of an announce
+type AnnounceRequest struct {
+	InfoHash []byte
+	PeerID   [20]byte
+	Port     int // port we accept peer connections on
+	Left     int // number of bytes left to download, 0 for a seeder
+}
+
+// Announce to the trackers of a torrent and ask them for peers, following BEP
+// 12. Within a tier, trackers are tried in order until one responds, and the
+// responsive tracker is moved to the front of its tier, in place: callers
+// sharing tiers must pass a copy. Peers returned by every tier are merged.
+func AnnounceTiers(ctx context.Context, tiers [][]string, req *AnnounceRequest) ([]netip.AddrPort, error) {
+	peers := make([]netip.AddrPort, 0)
+	seen := make(map[netip.AddrPort]bool)
+	responded := false
+	var lastErr error
+
+	for _, tier := range tiers {
+		for i, trackerUrl := range tier {
+			tierPeers, err := Announce(ctx, trackerUrl, req)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				dprintf("Tracker %v failed: %v\n", trackerUrl, err)
+				lastErr = err
+				continue
+			}
+
+			copy(tier[1:i+1], tier[0:i])
+			tier[0] = trackerUrl
+			responded = true
+
+			for _, peer := range tierPeers {
+				if !seen[peer] {
+					seen[peer] = true
+					peers = append(peers, peer)
+				}
+			}
+			break
+		}
+	}
+
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("no tracker")
+	}
+	if !responded {
+		return nil, fmt.Errorf("no tracker responded, last error: %w", lastErr)
+	}
+	return peers, nil
+}
+
+// Ask a single tracker for peers. The protocol is selected by the scheme of
+// the tracker URL: http(s):// or udp://. The request fails after Timeout.
+func Announce(ctx context.Context, trackerUrl string, req *AnnounceRequest) ([]netip.AddrPort, error) {
+	u, err := url.Parse(trackerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(ctx, trackerUrl, req)
+	case "udp":
+		return announceUDP(ctx, u.Host, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol: %v", u.Scheme)
+	}
+}
+
+// Response of an HTTP tracker to an announce
+type announceResponse struct {
+	FailureReason string            `bencode:"failure reason"`
+	Peers         decode.RawMessage `bencode:"peers"` // compact string or list of peer dicts
+	Peers6        []byte            `bencode:"peers6"`
+}
+
+// A peer in a noncompact announce response
+type peerDict struct {
+	IP   string `bencode:"ip"`
+	Port uint16 `bencode:"port"`
+}
+
+func announceHTTP(ctx context.Context, trackerUrl string, announce *AnnounceRequest) ([]netip.AddrPort, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", trackerUrl, nil)
+	if err != nil {
+		return []netip.AddrPort{}, err
+	}
+
+	query := req.URL.Query()
+	query.Add("info_hash", string(announce.InfoHash))
+	query.Add("peer_id", string(announce.PeerID[:]))
+	query.Add("port", strconv.Itoa(announce.Port))
+	query.Add("uploaded", "0")
+	query.Add("downloaded", "0")
+	query.Add("left", strconv.Itoa(announce.Left))
+	query.Add("compact", "1")
+	req.URL.RawQuery = query.Encode()
+
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return []netip.AddrPort{}, err
+	}
+
+	defer resp.Body.Close()
+
+	var decoded announceResponse
+	err = responseConfig.NewDecoder(resp.Body).Decode(&decoded)
+	if err != nil {
+		return []netip.AddrPort{}, err
+	}
+	if decoded.FailureReason != "" {
+		return nil, &Error{Tracker: trackerUrl, Reason: decoded.FailureReason}
+	}
+
+	peer_addrports := make([]netip.AddrPort, 0)
+	if len(decoded.Peers) == 0 {
+		return nil, fmt.Errorf("tracker response has no peers")
+	} else if decoded.Peers[0] == 'l' {
+		// noncompact
+		var peers []peerDict
+		err = responseConfig.Unmarshal(decoded.Peers, &peers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peers in tracker response: %w", err)
+		}
+		for _, peer := range peers {
+			addr, err := netip.ParseAddr(peer.IP)
+			if err != nil {
+				return nil, err
+			}
+			peer_addrports = append(peer_addrports, netip.AddrPortFrom(addr, peer.Port))
+		}
+	} else {
+		// compact
+		var peers []byte
+		err = responseConfig.Unmarshal(decoded.Peers, &peers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peers in tracker response: %w", err)
+		}
+		peer_addrports = append(peer_addrports, ParseCompactPeers(peers, 4)...)
+	}
+
+	// IPv6 peers in compact format (BEP 7)
+	peer_addrports = append(peer_addrports, ParseCompactPeers(decoded.Peers6, 16)...)
+
+	return peer_addrports, nil
+}
+
+// Parse peers in compact format. Each peer is represented with addrLen bytes
+// of IP (4 for IPv4, 16 for IPv6), followed by 2 bytes of port in big-endian
+// order. Trailing bytes not making up a full peer are ignored.
+func ParseCompactPeers(peers []byte, addrLen int) []netip.AddrPort {
+	peerLen := addrLen + 2
+	res := make([]netip.AddrPort, 0, len(peers)/peerLen)
+	for i := 0; i+peerLen <= len(peers); i += peerLen {
+		addr, _ := netip.AddrFromSlice(peers[i : i+addrLen])
+		port := binary.BigEndian.Uint16(peers[i+addrLen : i+peerLen])
+		res = append(res, netip.AddrPortFrom(addr, port))
+	}
+	return res
+}
+
+// Encode peers in compact format, the inverse of ParseCompactPeers. Peers of
+// the other IP version are skipped.
+func EncodeCompactPeers(peers []netip.AddrPort, addrLen int) []byte {
+	res := make([]byte, 0, len(peers)*(addrLen+2))
+	for _, peer := range peers {
+		addr := peer.Addr().Unmap()
+		if (addrLen == 4) != addr.Is4() {
+			continue
+		}
+		res = append(res, addr.AsSlice()...)
+		res = append(res, byte(peer.Port()>>8), byte(peer.Port()))
+	}
+	return res
+}
@@ -0,0 +1,312 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+//
+// Every request starts with a 16-byte header:
+// - 8-byte connection id (the protocol id for connect requests)
+// - 4-byte action
+// - 4-byte transaction id
+// Every response starts with an 8-byte header:
+// - 4-byte action
+// - 4-byte transaction id
+const udpProtocolId = 0x41727101980
+
+const (
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+)
+
+// A connection id can be used for one minute after it's received
+const udpConnectionIdTTL = time.Minute
+
+// A request is retransmitted if no response is received after 15 * 2^n
+// seconds, where n starts at 0 and goes up to udpMaxRetransmits (BEP 15).
+//
+// The full schedule takes over an hour, longer than we want to wait for a
+// tracker when other trackers or the DHT may respond. Announce and Scrape cap
+// it at Timeout instead: with the defaults, a request is sent at 0 and 15
+// seconds, and the tracker is given up on at 30 seconds. A variable so that
+// tests can shorten the schedule.
+var udpRetransmitTimeout = 15 * time.Second
+
+const udpMaxRetransmits = 8
+
+// Maximum number of info hashes in a single scrape request
+const udpMaxScrapeHashes = 74
+
+// Client state for a single UDP tracker. Requests to the same tracker are
+// serialized so they can share the connection id.
+type udpTracker struct {
+	mu           sync.Mutex
+	addr         string
+	conn         *net.UDPConn
+	ipv6         bool // peers in announce responses are IPv6 when talking to the tracker over IPv6
+	connectionId uint64
+	connectedAt  time.Time
+}
+
+// UDP trackers by address, so connection ids are reused across requests.
+var udpTrackers = struct {
+	sync.Mutex
+	m map[string]*udpTracker
+}{m: make(map[string]*udpTracker)}
+
+func getUDPTracker(hostport string) (*udpTracker, error) {
+	udpTrackers.Lock()
+	defer udpTrackers.Unlock()
+
+	if tracker, ok := udpTrackers.m[hostport]; ok {
+		return tracker, nil
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tracker := &udpTracker{
+		addr: hostport,
+		conn: conn,
+		ipv6: raddr.IP.To4() == nil,
+	}
+	udpTrackers.m[hostport] = tracker
+	return tracker, nil
+}
+
+func announceUDP(ctx context.Context, hostport string, req *AnnounceRequest) ([]netip.AddrPort, error) {
+	tracker, err := getUDPTracker(hostport)
+	if err != nil {
+		return nil, err
+	}
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	// announce request after the header:
+	// - 20-byte info hash
+	// - 20-byte peer id
+	// - 8-byte downloaded
+	// - 8-byte left
+	// - 8-byte uploaded
+	// - 4-byte event (0: none)
+	// - 4-byte IP address (0: use the sender address)
+	// - 4-byte key
+	// - 4-byte num want (-1: default)
+	// - 2-byte port
+	body := make([]byte, 82)
+	copy(body[0:20], req.InfoHash)
+	copy(body[20:40], req.PeerID[:])
+	binary.BigEndian.PutUint64(body[48:56], uint64(req.Left))
+	binary.BigEndian.PutUint32(body[72:76], rand.Uint32())
+	binary.BigEndian.PutUint32(body[76:80], 0xffffffff)
+	binary.BigEndian.PutUint16(body[80:82], uint16(req.Port))
+
+	resp, err := tracker.roundTrip(ctx, udpActionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// announce response after the header:
+	// - 4-byte interval
+	// - 4-byte leechers
+	// - 4-byte seeders
+	// - peers in compact format
+	if len(resp) < 12 {
+		return nil, fmt.Errorf("udp tracker %v: announce response too short", tracker.addr)
+	}
+	addrLen := 4
+	if tracker.ipv6 {
+		addrLen = 16
+	}
+	return ParseCompactPeers(resp[12:], addrLen), nil
+}
+
+// Scrape the tracker for the given info hashes. Hashes are sent in batches of
+// at most udpMaxScrapeHashes, each batch failing after Timeout.
+func (tracker *udpTracker) scrape(ctx context.Context, infoHashes [][]byte) ([]ScrapeResult, error) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += udpMaxScrapeHashes {
+		end := start + udpMaxScrapeHashes
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+
+		// scrape request after the header: 20-byte info hashes
+		body := make([]byte, 0, 20*(end-start))
+		for _, infoHash := range infoHashes[start:end] {
+			body = append(body, infoHash...)
+		}
+
+		batchCtx, cancel := context.WithTimeout(ctx, Timeout)
+		resp, err := tracker.roundTrip(batchCtx, udpActionScrape, body)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+
+		// scrape response after the header, for each info hash:
+		// - 4-byte seeders
+		// - 4-byte completed
+		// - 4-byte leechers
+		if len(resp) < 12*(end-start) {
+			return nil, fmt.Errorf("udp tracker %v: scrape response too short", tracker.addr)
+		}
+		for i := 0; i < end-start; i++ {
+			results = append(results, ScrapeResult{
+				Seeders:   int(binary.BigEndian.Uint32(resp[12*i : 12*i+4])),
+				Completed: int(binary.BigEndian.Uint32(resp[12*i+4 : 12*i+8])),
+				Leechers:  int(binary.BigEndian.Uint32(resp[12*i+8 : 12*i+12])),
+			})
+		}
+	}
+
+	return results, nil
+}
+
+// Make sure we hold a connection id that hasn't expired.
+func (tracker *udpTracker) connect(ctx context.Context) error {
+	if !tracker.connectedAt.IsZero() && time.Since(tracker.connectedAt) < udpConnectionIdTTL {
+		return nil
+	}
+
+	// connect response after the header: 8-byte connection id
+	resp, err := tracker.roundTrip(ctx, udpActionConnect, nil)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 8 {
+		return fmt.Errorf("udp tracker %v: connect response too short", tracker.addr)
+	}
+
+	tracker.connectionId = binary.BigEndian.Uint64(resp[0:8])
+	tracker.connectedAt = time.Now()
+	return nil
+}
+
+// Send a request and return the response body after the header. The request
+// is retransmitted until a response with the same transaction id arrives. A new
+// connection id is requested first if the current one has expired. Waiting
+// for the response stops when ctx is done.
+func (tracker *udpTracker) roundTrip(ctx context.Context, action uint32, body []byte) ([]byte, error) {
+	stop := tracker.interruptOnCancel(ctx)
+	defer stop()
+
+	for n := 0; n <= udpMaxRetransmits; n++ {
+		connectionId := uint64(udpProtocolId)
+		if action != udpActionConnect {
+			err := tracker.connect(ctx)
+			if err != nil {
+				return nil, err
+			}
+			connectionId = tracker.connectionId
+		}
+
+		transactionId := rand.Uint32()
+		req := make([]byte, 16+len(body))
+		binary.BigEndian.PutUint64(req[0:8], connectionId)
+		binary.BigEndian.PutUint32(req[8:12], action)
+		binary.BigEndian.PutUint32(req[12:16], transactionId)
+		copy(req[16:], body)
+
+		_, err := tracker.conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+
+		timeout := udpRetransmitTimeout * time.Duration(1<<n)
+		resp, err := tracker.readResponse(ctx, action, transactionId, time.Now().Add(timeout))
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			dprintf("udp tracker %v: no response after %v, retransmitting\n", tracker.addr, timeout)
+			continue
+		}
+		return resp, err
+	}
+
+	return nil, fmt.Errorf("udp tracker %v: no response", tracker.addr)
+}
+
+// Make a pending read on the tracker connection return when ctx is cancelled,
+// until the returned function is called. The connection is shared, so it's
+// not closed, but its read deadline is moved to now.
+func (tracker *udpTracker) interruptOnCancel(ctx context.Context) func() {
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			tracker.conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-exited
+	}
+}
+
+// Wait for the response until deadline, or the deadline of ctx if it's
+// earlier.
+func (tracker *udpTracker) readResponse(ctx context.Context, action uint32, transactionId uint32, deadline time.Time) ([]byte, error) {
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err := tracker.conn.SetReadDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+	// ctx may have been cancelled before the deadline was set, in which case
+	// interruptOnCancel's deadline was overwritten
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := tracker.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionId {
+			// not a response to this request
+			continue
+		}
+
+		respAction := binary.BigEndian.Uint32(buf[0:4])
+		if respAction == udpActionError {
+			// error response after the header: a message
+			return nil, &Error{Tracker: tracker.addr, Reason: string(buf[8:n])}
+		}
+		if respAction != action {
+			return nil, fmt.Errorf("udp tracker %v: expected action %v, got %v", tracker.addr, action, respAction)
+		}
+
+		resp := make([]byte, n-8)
+		copy(resp, buf[8:n])
+		return resp, nil
+	}
+}
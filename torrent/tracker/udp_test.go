@@ -0,0 +1,160 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stand-in for a UDP tracker that drops the first dropPerAction requests of
+// each action and answers the following ones.
+type fakeUDPTracker struct {
+	conn          *net.UDPConn
+	dropPerAction int
+	peers         []netip.AddrPort
+	scrape        ScrapeResult
+
+	mu       sync.Mutex
+	received map[uint32]int // requests received by action
+}
+
+// Listen on the loopback interface and serve requests until the test ends.
+// The responses must be set before.
+func (tracker *fakeUDPTracker) start(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	tracker.conn = conn
+	tracker.received = make(map[uint32]int)
+	go tracker.serve()
+}
+
+func (tracker *fakeUDPTracker) url() string {
+	return "udp://" + tracker.conn.LocalAddr().String()
+}
+
+func (tracker *fakeUDPTracker) numReceived(action uint32) int {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return tracker.received[action]
+}
+
+func (tracker *fakeUDPTracker) serve() {
+	const connectionId = 0x1234567890
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := tracker.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+		action := binary.BigEndian.Uint32(buf[8:12])
+
+		tracker.mu.Lock()
+		tracker.received[action]++
+		drop := tracker.received[action] <= tracker.dropPerAction
+		tracker.mu.Unlock()
+		if drop {
+			continue
+		}
+
+		resp := make([]byte, 8, 64*1024)
+		copy(resp, buf[8:16])
+		switch action {
+		case udpActionConnect:
+			resp = resp[:16]
+			binary.BigEndian.PutUint64(resp[8:16], connectionId)
+		case udpActionAnnounce, udpActionScrape:
+			if binary.BigEndian.Uint64(buf[0:8]) != connectionId {
+				continue
+			}
+			if action == udpActionAnnounce {
+				resp = append(resp, make([]byte, 12)...)
+				resp = append(resp, EncodeCompactPeers(tracker.peers, 4)...)
+			} else {
+				for i := 16; i+20 <= n; i += 20 {
+					result := make([]byte, 12)
+					binary.BigEndian.PutUint32(result[0:4], uint32(tracker.scrape.Seeders))
+					binary.BigEndian.PutUint32(result[4:8], uint32(tracker.scrape.Completed))
+					binary.BigEndian.PutUint32(result[8:12], uint32(tracker.scrape.Leechers))
+					resp = append(resp, result...)
+				}
+			}
+		default:
+			continue
+		}
+		tracker.conn.WriteToUDP(resp, addr)
+	}
+}
+
+func shortenUDPRetransmitTimeout(t *testing.T, timeout time.Duration) {
+	saved := udpRetransmitTimeout
+	udpRetransmitTimeout = timeout
+	t.Cleanup(func() { udpRetransmitTimeout = saved })
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	shortenUDPRetransmitTimeout(t, 50*time.Millisecond)
+	fake := &fakeUDPTracker{
+		dropPerAction: 1,
+		peers: []netip.AddrPort{
+			netip.MustParseAddrPort("1.2.3.4:6881"),
+			netip.MustParseAddrPort("5.6.7.8:51413"),
+		},
+		scrape: ScrapeResult{Seeders: 3, Completed: 7, Leechers: 2},
+	}
+	fake.start(t)
+
+	infoHash := make([]byte, 20)
+	infoHash[0] = 1
+	peers, err := Announce(context.Background(), fake.url(), &AnnounceRequest{InfoHash: infoHash, Port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(peers, fake.peers) {
+		t.Fatalf("Mismatch! Expected: %v, result: %v", fake.peers, peers)
+	}
+
+	results, err := Scrape(context.Background(), fake.url(), [][]byte{infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]ScrapeResult{string(infoHash): fake.scrape}
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("Mismatch! Expected: %v, result: %v", expected, results)
+	}
+
+	// Every dropped request was sent again, and the connection id was reused
+	for _, action := range []uint32{udpActionConnect, udpActionAnnounce, udpActionScrape} {
+		if received := fake.numReceived(action); received != 2 {
+			t.Errorf("Expected 2 requests with action %v, got %v", action, received)
+		}
+	}
+}
+
+func TestUDPRetransmitBackoff(t *testing.T) {
+	shortenUDPRetransmitTimeout(t, 50*time.Millisecond)
+	fake := &fakeUDPTracker{dropPerAction: 1000}
+	fake.start(t)
+
+	// Sent at 0, 50, 150, 350 and 750ms, the next one would be at 1550ms
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := Announce(ctx, fake.url(), &AnnounceRequest{InfoHash: make([]byte, 20), Port: 6881})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if received := fake.numReceived(udpActionConnect); received != 5 {
+		t.Fatalf("Expected 5 connect requests, got %v", received)
+	}
+}
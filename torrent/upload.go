@@ -0,0 +1,187 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent/peer"
+)
+
+// Largest block a peer may request. Most clients request 16 KiB blocks, but
+// some use larger ones.
+const MaxBlockRequest = 128 * 1024
+
+// Serves the block requests of peers from the torrent data, both while seeding
+// and while downloading. The choker decides which peers are served.
+type uploader struct {
+	torrent *Torrent
+	storage io.ReaderAt
+	has     func(piece int) bool // whether the piece is verified and can be served
+	choker  *choker
+}
+
+// Start serving the peer. Its interested, request and cancel messages are
+// handed to the uploader through pc.OnUploadMsg. Call the returned function
+// once the peer disconnects.
+func (u *uploader) addPeer(pc *peer.Conn) func() {
+	u.choker.add(pc)
+	queue := newUploadQueue()
+	go u.upload(pc, queue)
+
+	pc.OnUploadMsg = func(msg peerwire.Message) error {
+		return u.handleMsg(pc, queue, msg)
+	}
+	return func() {
+		queue.close()
+		u.choker.remove(pc)
+	}
+}
+
+func (u *uploader) handleMsg(pc *peer.Conn, queue *uploadQueue, msg peerwire.Message) error {
+	switch msg := msg.(type) {
+	case peerwire.Interested:
+		pc.SetInterested(true)
+		return u.choker.peerInterested(pc)
+	case peerwire.NotInterested:
+		pc.SetInterested(false)
+	case peerwire.Request:
+		err := u.checkRequest(msg)
+		if err != nil {
+			return err
+		}
+		if !pc.IsChoking() {
+			// Requests beyond the advertised limit are dropped
+			queue.push(msg, peer.MaxPeerRequests)
+		}
+	case peerwire.Cancel:
+		queue.remove(peerwire.Request(msg))
+	}
+	return nil
+}
+
+// Check that a requested block lies within a piece we have.
+func (u *uploader) checkRequest(req peerwire.Request) error {
+	piece, offset, length := int(req.Index), int64(req.Begin), int64(req.Length)
+	if piece >= u.torrent.NumPieces() || !u.has(piece) {
+		return fmt.Errorf("%w: request for piece %v we don't have", peer.ErrUnexpectedMessage, piece)
+	}
+	if length == 0 || length > MaxBlockRequest {
+		return fmt.Errorf("%w: invalid request length: %v", peer.ErrUnexpectedMessage, length)
+	}
+	if offset+length > int64(u.torrent.PieceSize(piece)) {
+		return fmt.Errorf("%w: request out of range: piece %v, offset %v, length %v", peer.ErrUnexpectedMessage, piece, offset, length)
+	}
+	return nil
+}
+
+// Send the requested blocks to the peer, in the order they were requested.
+// Requests still queued when the peer gets choked are discarded, the peer has
+// to request them again once unchoked.
+func (u *uploader) upload(pc *peer.Conn, queue *uploadQueue) {
+	for {
+		req, ok := queue.pop()
+		if !ok {
+			return
+		}
+		if pc.IsChoking() {
+			continue
+		}
+
+		block := make([]byte, req.Length)
+		offset := int64(req.Index)*int64(u.torrent.Info.PieceLength) + int64(req.Begin)
+		_, err := u.storage.ReadAt(block, offset)
+		if err != nil {
+			dprintf("Failed to read piece %v: %v\n", req.Index, err)
+			pc.Close()
+			return
+		}
+
+		err = pc.Send(peerwire.Piece{Index: req.Index, Begin: req.Begin, Block: block})
+		if err != nil {
+			pc.Close()
+			return
+		}
+		pc.RecordUploaded(len(block))
+	}
+}
+
+// Blocks requested by a peer and not sent yet. Requests are queued by the
+// connection's reader and consumed by its uploader, so that a cancel message
+// can remove a request before the block is sent.
+type uploadQueue struct {
+	mu       sync.Mutex
+	requests []peerwire.Request
+	ready    chan struct{} // signaled when requests are added
+	closed   bool
+}
+
+func newUploadQueue() *uploadQueue {
+	return &uploadQueue{ready: make(chan struct{}, 1)}
+}
+
+// Queue a request, unless it's a duplicate or the queue already holds limit
+// requests.
+func (q *uploadQueue) push(req peerwire.Request, limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.requests) >= limit {
+		return
+	}
+	for _, r := range q.requests {
+		if r == req {
+			return
+		}
+	}
+	q.requests = append(q.requests, req)
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *uploadQueue) remove(req peerwire.Request) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, r := range q.requests {
+		if r == req {
+			q.requests = append(q.requests[:i], q.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+// Wait for the next request. Returns false once the queue is closed.
+func (q *uploadQueue) pop() (peerwire.Request, bool) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return peerwire.Request{}, false
+		}
+		if len(q.requests) > 0 {
+			req := q.requests[0]
+			q.requests = q.requests[1:]
+			q.mu.Unlock()
+			return req, true
+		}
+		q.mu.Unlock()
+
+		<-q.ready
+	}
+}
+
+func (q *uploadQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}